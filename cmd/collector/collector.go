@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrngm/apploos/util"
+)
+
+// Collector fetches all sources of a Config, each on its own schedule, using a bounded pool of workers.
+type Collector struct {
+	cfg     *Config
+	saveDir string
+	state   *StateStore
+	// grace is how long in-flight fetches may continue after Run was asked to stop
+	grace time.Duration
+
+	reloadCh  chan *Config
+	triggerCh chan struct{}
+
+	mu      sync.Mutex
+	sources map[string]*runningSource
+
+	// hooks tracks running change hooks, such that Run can wait for them
+	hooks sync.WaitGroup
+
+	metrics *Metrics
+	// ready is set while Run schedules fetches
+	ready atomic.Bool
+}
+
+// runningSource is a source with a running scheduler.
+type runningSource struct {
+	src     *Source
+	breaker *CircuitBreaker
+	// trigger makes the scheduler fetch right away
+	trigger chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+	// fetcher is reused for every fetch of the source, such that e.g. connections and session cookies are kept
+	fetcher Fetcher
+}
+
+// collectJob is handed from a source's scheduler to a worker. The worker reports the result on done.
+type collectJob struct {
+	src     *Source
+	fetcher Fetcher
+	done    chan error
+}
+
+// NewCollector prepares a Collector for cfg, which must be validated already. It creates the storage directories of
+// all sources inside saveDir. After Run was asked to stop, in-flight fetches get grace to finish before they're
+// cancelled.
+func NewCollector(cfg *Config, saveDir string, state *StateStore, grace time.Duration) (*Collector, error) {
+	c := &Collector{
+		cfg:       cfg,
+		saveDir:   saveDir,
+		state:     state,
+		grace:     grace,
+		reloadCh:  make(chan *Config, 1),
+		triggerCh: make(chan struct{}, 1),
+		sources:   make(map[string]*runningSource),
+		metrics:   NewMetrics(),
+	}
+	if err := c.prepareStorage(cfg); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Collector) prepareStorage(cfg *Config) error {
+	for _, src := range cfg.Sources {
+		dir := c.storageDir(src)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			slog.Error("cannot create storage directory", "err", err, "src", src.Name, "dir", dir)
+			return err
+		}
+		// Readers may lack the permission to create the snapshot lock file themselves
+		f, err := os.OpenFile(filepath.Join(dir, util.SnapshotLockName), os.O_RDONLY|os.O_CREATE, 0644)
+		if err != nil {
+			slog.Error("cannot create snapshot lock file", "err", err, "src", src.Name, "dir", dir)
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
+
+func (c *Collector) storageDir(src *Source) string {
+	return filepath.Join(c.saveDir, src.Storage)
+}
+
+// store returns the Store that keeps the snapshots of src, in its storage directory.
+func (c *Collector) store(src *Source) util.Store {
+	return util.NewFSStore(c.storageDir(src), *cleanupTmp)
+}
+
+// Metrics returns the metrics of the collector.
+func (c *Collector) Metrics() *Metrics {
+	return c.metrics
+}
+
+// Ready reports whether the collector is scheduling fetches, i.e. Run was called and wasn't asked to stop yet.
+func (c *Collector) Ready() bool {
+	return c.ready.Load()
+}
+
+// Sources returns the names of the sources that are currently scheduled.
+func (c *Collector) Sources() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make([]string, 0, len(c.sources))
+	for name := range c.sources {
+		ret = append(ret, name)
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+// Reload replaces the configured sources by those of cfg, which must be validated already. Sources that didn't change
+// keep their schedule, changed sources are restarted, and removed sources stop after their in-flight fetch. A change
+// in the number of workers only takes effect after a restart. Reload doesn't wait for Run to pick up cfg: if an earlier
+// configuration is still pending, cfg replaces it.
+func (c *Collector) Reload(cfg *Config) error {
+	if err := c.prepareStorage(cfg); err != nil {
+		return err
+	}
+	for {
+		select {
+		case c.reloadCh <- cfg:
+			return nil
+		default:
+		}
+		select {
+		case <-c.reloadCh:
+			slog.Info("replacing configuration that wasn't applied yet")
+		default:
+		}
+	}
+}
+
+// TriggerAll makes every source fetch right away, regardless of its schedule.
+func (c *Collector) TriggerAll() {
+	select {
+	case c.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run fetches every source according to its schedule until ctx is done. If once is given, every source is fetched
+// exactly once and Run returns as soon as all of them are done.
+//
+// Once ctx is done, no new fetches are scheduled. In-flight fetches get the grace period to finish, after which they
+// are cancelled. Run returns after all workers are done and the collector state is saved.
+func (c *Collector) Run(ctx context.Context, once bool) {
+	// In-flight fetches outlive ctx by the grace period
+	fetchCtx, cancelFetches := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelFetches()
+	go func() {
+		select {
+		case <-fetchCtx.Done():
+			return
+		case <-ctx.Done():
+		}
+		slog.Info("stopped scheduling, waiting for in-flight fetches", "grace", c.grace)
+		graceTimer := time.NewTimer(c.grace)
+		defer graceTimer.Stop()
+		select {
+		case <-fetchCtx.Done():
+		case <-graceTimer.C:
+			slog.Warn("grace period expired, cancelling in-flight fetches", "grace", c.grace)
+			cancelFetches()
+		}
+	}()
+
+	jobs := make(chan collectJob)
+	var workersWg sync.WaitGroup
+	for i := 0; i < c.cfg.Workers; i++ {
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+			for job := range jobs {
+				job.done <- c.collectSafely(fetchCtx, job.src, job.fetcher)
+			}
+		}()
+	}
+	slog.Info("collector started", "workers", c.cfg.Workers, "sources", len(c.cfg.Sources), "once", once)
+
+	c.startSources(ctx, c.cfg.Sources, jobs, once)
+	c.ready.Store(true)
+	if !once {
+		c.manage(ctx, jobs)
+	}
+	c.ready.Store(false)
+	c.mu.Lock()
+	running := make([]*runningSource, 0, len(c.sources))
+	for _, rs := range c.sources {
+		running = append(running, rs)
+	}
+	c.mu.Unlock()
+	for _, rs := range running {
+		<-rs.done
+	}
+
+	close(jobs)
+	workersWg.Wait()
+	// Change hooks run on the same terms as in-flight fetches
+	c.hooks.Wait()
+	cancelFetches()
+
+	// Flush the collector state, in case persisting one of the updates failed along the way
+	if err := c.state.Save(context.Background()); err != nil {
+		slog.Error("failed saving collector state", "err", err)
+	}
+	slog.Info("collector stopped")
+}
+
+// manage handles reloads and triggers until ctx is done.
+func (c *Collector) manage(ctx context.Context, jobs chan<- collectJob) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cfg := <-c.reloadCh:
+			c.applyConfig(ctx, cfg, jobs)
+		case <-c.triggerCh:
+			c.mu.Lock()
+			slog.Info("fetching all sources now", "sources", len(c.sources))
+			for _, rs := range c.sources {
+				select {
+				case rs.trigger <- struct{}{}:
+				default:
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// startSources starts a scheduler for every source in sources.
+func (c *Collector) startSources(ctx context.Context, sources []*Source, jobs chan<- collectJob, once bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, src := range sources {
+		srcCtx, cancel := context.WithCancel(ctx)
+		rs := &runningSource{
+			src:     src,
+			breaker: NewCircuitBreaker(src.Breaker),
+			trigger: make(chan struct{}, 1),
+			cancel:  cancel,
+			done:    make(chan struct{}),
+		}
+		f, err := NewFetcher(src)
+		if err != nil {
+			// The source was validated, so this is unlikely. FetchSource tries again for every fetch.
+			slog.Error("cannot build fetcher for source", "err", err, "src", src.Name)
+		}
+		rs.fetcher = f
+		c.sources[src.Name] = rs
+		go func() {
+			defer close(rs.done)
+			defer cancel()
+			c.schedule(srcCtx, rs, jobs, once)
+			if closer, ok := rs.fetcher.(io.Closer); ok {
+				if err := closer.Close(); err != nil {
+					slog.Error("closing fetcher failed", "err", err, "src", src.Name)
+				}
+			}
+		}()
+	}
+}
+
+// applyConfig stops the schedulers of removed and changed sources, and starts those of new and changed sources.
+func (c *Collector) applyConfig(ctx context.Context, cfg *Config, jobs chan<- collectJob) {
+	if cfg.Workers != c.cfg.Workers {
+		slog.Warn("changing the number of workers requires a restart", "workers", c.cfg.Workers, "configured", cfg.Workers)
+	}
+	wanted := make(map[string]*Source, len(cfg.Sources))
+	for _, src := range cfg.Sources {
+		wanted[src.Name] = src
+	}
+
+	c.mu.Lock()
+	stopping := make([]*runningSource, 0)
+	for name, rs := range c.sources {
+		if src, ok := wanted[name]; ok && reflect.DeepEqual(src, rs.src) {
+			delete(wanted, name)
+			continue
+		}
+		rs.cancel()
+		stopping = append(stopping, rs)
+		delete(c.sources, name)
+	}
+	c.mu.Unlock()
+
+	// Wait for the stopped schedulers (and their in-flight fetch), such that a changed source is never fetched twice
+	// at the same time
+	for _, rs := range stopping {
+		<-rs.done
+		slog.Info("stopped source", "src", rs.src.Name)
+		if _, ok := wanted[rs.src.Name]; !ok {
+			c.metrics.Forget(rs.src.Name)
+		}
+	}
+
+	starting := make([]*Source, 0, len(wanted))
+	for _, src := range cfg.Sources {
+		if _, ok := wanted[src.Name]; ok {
+			starting = append(starting, src)
+			slog.Info("starting source", "src", src.Name)
+		}
+	}
+	c.startSources(ctx, starting, jobs, false)
+	c.cfg = &Config{Workers: c.cfg.Workers, Sources: cfg.Sources}
+	slog.Info("reloaded configuration", "sources", len(cfg.Sources), "stopped", len(stopping), "started", len(starting))
+}
+
+// schedule hands the source of rs to the workers every interval, until ctx is done. A source is never handed over again
+// before the previous fetch finished, so slow sources don't pile up.
+//
+// Transient failures are retried with backoff according to the RetryPolicy of the source. Failures never stop the
+// schedule, but a source that keeps failing is polled slower by its CircuitBreaker. If once is given, the source is
+// fetched a single time, retries included, unless it asks to wait longer than the backoff (e.g. with Retry-After).
+func (c *Collector) schedule(ctx context.Context, rs *runningSource, jobs chan<- collectJob, once bool) {
+	src, breaker := rs.src, rs.breaker
+
+	// Spread the first fetch of every source, such that they don't all start at the same time
+	firstDelay, scheduled := time.Duration(0), true
+	if !once {
+		firstDelay, scheduled = src.FirstDelay(c.state.Get(src.Name))
+	}
+	// A source that asked not to be fetched for a while is left alone, even across restarts
+	if wait := time.Until(c.state.Get(src.Name).NotBefore); !once && wait > firstDelay {
+		slog.Info("source asked to wait before fetching", "src", src.Name, "wait", wait)
+		firstDelay = wait
+	}
+	timer := time.NewTimer(firstDelay)
+	defer timer.Stop()
+	if !scheduled {
+		timer.Stop()
+		slog.Info("schedule has no more fetches for source, only fetching on request", "src", src.Name)
+	}
+
+	// A nil channel blocks forever, so without Watch the select below only considers the timer
+	var watchCh <-chan struct{}
+	if src.Watch > 0 && !once {
+		var err error
+		if watcher, ok := rs.fetcher.(Watcher); !ok {
+			err = fmt.Errorf("source cannot be watched")
+		} else {
+			watchCh, err = watcher.Watch(ctx, time.Duration(src.Watch))
+		}
+		if err != nil {
+			slog.Error("cannot watch source, relying on interval only", "err", err, "src", src.Name)
+		} else {
+			slog.Info("watching source for changes", "src", src.Name, "interval", time.Duration(src.Watch))
+		}
+	}
+
+	attempt := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-rs.trigger:
+			slog.Info("fetching source on request", "src", src.Name)
+		case _, ok := <-watchCh:
+			if !ok {
+				watchCh = nil
+				continue
+			}
+			slog.Info("source changed, fetching", "src", src.Name)
+		}
+
+		job := collectJob{src: src, fetcher: rs.fetcher, done: make(chan error, 1)}
+		select {
+		case <-ctx.Done():
+			return
+		case jobs <- job:
+		}
+		err := <-job.done
+		st := c.state.Get(src.Name)
+
+		var newInterval time.Duration
+		scheduled := true
+		switch {
+		case err == nil:
+			attempt = 0
+			breaker.Success()
+			newInterval, scheduled = src.NextInterval(st)
+		case ctx.Err() != nil:
+			return
+		case IsTransient(err) && attempt < src.Retry.Attempts:
+			newInterval = src.Retry.Backoff.Duration(attempt)
+			attempt++
+			slog.Warn("transient failure, retrying", "err", err, "src", src.Name, "attempt", attempt, "maxAttempts", src.Retry.Attempts, "backoff", newInterval)
+		default:
+			failures := breaker.Failure()
+			newInterval, scheduled = src.NextInterval(st)
+			newInterval = breaker.Interval(newInterval)
+			slog.Error("collecting source failed", "err", err, "src", src.Name, "transient", IsTransient(err), "retries", attempt, "consecutiveFailures", failures, "breakerOpen", breaker.Open(), "nextInterval", newInterval)
+			attempt = 0
+		}
+		if wait := time.Until(st.NotBefore); scheduled && wait > newInterval {
+			// Under -once, waiting would hold up the run (and the storage lock) for as long as the source likes. The
+			// wait is in the state already, for the next run.
+			if once {
+				slog.Warn("source asked to wait before fetching again, giving up", "src", src.Name, "wait", wait, "retries", attempt)
+				return
+			}
+			slog.Info("source asked to wait before fetching again", "src", src.Name, "wait", wait, "interval", newInterval)
+			newInterval = wait
+		}
+
+		c.metrics.Backoff(src.Name, attempt, breaker.Failures(), breaker.Open(), newInterval)
+
+		if once && attempt == 0 {
+			return
+		}
+
+		slog.Debug("refresh + jitter", "src", src.Name, "refreshInterval", time.Duration(src.Interval), "jitter", src.JitterFor(newInterval), "newInterval", newInterval)
+		// The timer may have fired while collecting, if a watch notification triggered it. Drain it before resetting.
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !scheduled {
+			slog.Info("schedule has no more fetches for source, only fetching on request", "src", src.Name)
+			continue
+		}
+		timer.Reset(newInterval)
+	}
+}
+
+// collectSafely calls collect, turning a panic into an error, such that a single misbehaving source cannot take down
+// the collector. The outcome is recorded in the metrics.
+func (c *Collector) collectSafely(ctx context.Context, src *Source, f Fetcher) (err error) {
+	start := time.Now()
+	outcome, size := OutcomeError, int64(0)
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("collect panicked", "src", src.Name, "panic", p)
+			err = fmt.Errorf("collect panicked: %v", p)
+		}
+		var rejected RejectedError
+		if errors.As(err, &rejected) {
+			outcome = OutcomeRejected
+		}
+		c.metrics.Fetched(src.Name, outcome, time.Since(start), size)
+	}()
+	outcome, size, err = c.collect(ctx, src, f)
+	return err
+}
+
+// collect fetches src once with f (see FetchSource), and streams the contents into the Store of the source, see
+// Collector.store. Once saved, the validators of the response are remembered in the collector state for the next
+// (conditional) fetch. Rejected responses are saved in quarantine instead. It returns an error if fetching, reading or
+// storing the source failed, or if the source exceeds its maximum size. The outcome is one of the Outcome constants,
+// size the size of the snapshot.
+//
+// A source that didn't change, either because it said so or because its checksum equals the previous one, is a normal
+// outcome: only the moment it was last seen is recorded. If the checksum equals that of an older snapshot (e.g. a
+// change was reverted), the snapshot stays as is, but its metadata is refreshed such that it's the latest snapshot
+// again.
+//
+// After storing a snapshot, the hooks of the source are notified if the checksum changed, and the store is pruned
+// according to the RetentionPolicy of the source.
+func (c *Collector) collect(ctx context.Context, src *Source, f Fetcher) (outcome string, size int64, err error) {
+	store := c.store(src)
+	fetchStart := time.Now()
+	prev := c.state.Get(src.Name)
+	prevSize := int64(0)
+	if prev.Checksum != "" {
+		// Only make a conditional request if we still have what the source would refer to, e.g. the storage
+		// directory might have changed
+		rc, prevMeta, err := store.Get(ctx, src.Name, prev.Checksum)
+		if err != nil {
+			slog.Info("previous snapshot is missing, fetching unconditionally", "err", err, "src", src.Name, "checksum", prev.Checksum)
+			prev.ETag, prev.LastModified = "", ""
+		} else {
+			rc.Close()
+			prevSize = prevMeta.Size
+		}
+	}
+	result, err := FetchSource(ctx, src, f, prev)
+	var rejected RejectedError
+	var statusErr *HTTPStatusError
+	if errors.Is(err, ErrNotModified) {
+		slog.Info("source not modified since previous fetch, nothing to store", "src", src.Name, "unchangedSince", prev.LastChanged)
+		if result != nil && result.Timings != nil {
+			c.metrics.HTTPTimings(src.Name, *result.Timings)
+		}
+		c.markSeen(ctx, src, nil, c.notBefore(src, result))
+		return OutcomeNotModified, 0, nil
+	} else if errors.As(err, &rejected) {
+		slog.Error("FetchSource rejected response", "err", err, "src", src.Name)
+		Quarantine(ctx, c.storageDir(src), src.URL, rejected)
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+			if err := c.state.Update(ctx, src.Name, func(st *SourceState) {
+				st.NotBefore = time.Now().Add(src.Poll.hint(statusErr.RetryAfter))
+			}); err != nil {
+				slog.Error("failed saving collector state", "err", err, "src", src.Name)
+			}
+		}
+		return OutcomeError, 0, err
+	} else if err != nil {
+		slog.Error("FetchSource failed", "err", err, "src", src.Name)
+		return OutcomeError, 0, err
+	}
+
+	body, err := c.normalize(src, result.Body)
+	if err == nil {
+		body, err = c.checkSanity(src, body, prevSize)
+	}
+	if err != nil {
+		if closeErr := result.Body.Close(); closeErr != nil {
+			slog.Error("closing FetchSource failed", "err", closeErr, "src", src.Name)
+		}
+		slog.Error("normalizing or checking source failed", "err", err, "src", src.Name)
+		var sanityErr *SanityError
+		if errors.As(err, &rejected) {
+			fn, _ := Quarantine(ctx, c.storageDir(src), src.URL, rejected)
+			if errors.As(err, &sanityErr) {
+				slog.Error("snapshot failed sanity check, quarantined it and keeping the previous one", "alert", true, "src", src.Name, "check", sanityErr.Check, "err", sanityErr.Err, "fn", fn, "previousChecksum", prev.Checksum)
+				c.runHooks(ctx, src.Sanity.AlertHooks, ChangeEvent{
+					Event:       EventSanity,
+					Reason:      sanityErr.Check + ": " + sanityErr.Err.Error(),
+					Source:      src.Name,
+					URL:         src.URL,
+					OldChecksum: prev.Checksum,
+					BlobPath:    fn,
+					RequestId:   result.RequestId,
+					FetchEnd:    time.Now(),
+				})
+			}
+		}
+		return OutcomeError, 0, err
+	}
+
+	// Without normalizing, hash and write in a single pass, without keeping the contents in memory
+	meta, err := store.Put(ctx, util.SnapshotMeta{
+		Source:     src.Name,
+		URL:        src.URL,
+		FetchStart: fetchStart,
+		RequestId:  result.RequestId,
+		StatusCode: result.StatusCode,
+		Status:     result.Status,
+		Header:     redactHeader(result.Header),
+		Timings:    result.Timings,
+	}, body, src.MaxSize)
+	if closeErr := result.Body.Close(); closeErr != nil {
+		slog.Error("closing FetchSource failed", "err", closeErr, "src", src.Name)
+	}
+	if result.Timings != nil {
+		c.metrics.HTTPTimings(src.Name, *result.Timings)
+	}
+	slog.Debug("Store.Put returns", "src", src.Name, "checksum", meta.Checksum, "size", meta.Size, "err", err)
+	if errors.Is(err, util.ErrDestinationExists) && meta.Checksum == prev.Checksum {
+		slog.Info("source unchanged", "src", src.Name, "checksum", meta.Checksum, "unchangedSince", prev.LastChanged)
+		c.markSeen(ctx, src, result, c.notBefore(src, result))
+		return OutcomeUnchanged, meta.Size, nil
+	} else if errors.Is(err, util.ErrDestinationExists) {
+		slog.Info("source changed into an earlier snapshot", "src", src.Name, "checksum", meta.Checksum, "previousChecksum", prev.Checksum)
+		if err := store.PutMeta(ctx, meta); err != nil {
+			slog.Error("failed saving snapshot metadata", "err", err, "src", src.Name, "checksum", meta.Checksum)
+		}
+	} else if errors.Is(err, util.ErrMaxSizeExceeded) {
+		slog.Error("source exceeds maximum size, not stored", "err", err, "src", src.Name, "maxSize", src.MaxSize)
+		return OutcomeError, 0, err
+	} else if err != nil {
+		slog.Error("failed storing snapshot", "err", err, "src", src.Name, "checksum", meta.Checksum)
+		return OutcomeError, 0, err
+	} else {
+		slog.Info("stored source", "src", src.Name, "checksum", meta.Checksum, "size", meta.Size, "previousChecksum", prev.Checksum)
+	}
+
+	if err := c.state.Update(ctx, src.Name, func(st *SourceState) {
+		st.ETag = result.ETag
+		st.LastModified = result.LastModified
+		st.Checksum = meta.Checksum
+		st.LastChanged = meta.FetchEnd
+		st.LastSeen = meta.FetchEnd
+		st.NotBefore = c.notBefore(src, result)
+	}); err != nil {
+		slog.Error("failed saving collector state", "err", err, "src", src.Name)
+	}
+
+	if meta.Checksum != prev.Checksum {
+		c.runHooks(ctx, src.Hooks, ChangeEvent{
+			Event:       EventChange,
+			Source:      src.Name,
+			URL:         src.URL,
+			OldChecksum: prev.Checksum,
+			NewChecksum: meta.Checksum,
+			BlobPath:    filepath.Join(c.storageDir(src), meta.BlobName()),
+			RequestId:   meta.RequestId,
+			FetchEnd:    meta.FetchEnd,
+		})
+	}
+
+	// The most recent snapshot of every source is protected, as sources may share a storage directory
+	if _, err := PruneSnapshots(ctx, store, src.Name, src.Retention, c.state.Checksums(), false); err != nil {
+		slog.Error("pruning snapshots failed", "err", err, "src", src.Name)
+	}
+	return OutcomeChanged, meta.Size, nil
+}
+
+// runHooks notifies hooks of ev in the background, such that a slow hook doesn't hold up a worker.
+func (c *Collector) runHooks(ctx context.Context, hooks []*Hook, ev ChangeEvent) {
+	for _, hook := range hooks {
+		c.hooks.Add(1)
+		go func() {
+			defer c.hooks.Done()
+			hook.Run(ctx, ev)
+		}()
+	}
+}
+
+// normalize returns body as is, or normalized according to the NormalizePolicy of src. Contents that cannot be
+// normalized result in a *NormalizeError.
+func (c *Collector) normalize(src *Source, body io.Reader) (io.Reader, error) {
+	if src.Normalize == nil {
+		return body, nil
+	}
+	contents, err := util.ReadAtMost(body, src.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	normalized, err := src.Normalize.Normalize(contents)
+	if err != nil {
+		if len(contents) > MaxRejectedBodySize {
+			contents = contents[:MaxRejectedBodySize]
+		}
+		return nil, &NormalizeError{URL: src.URL, Format: src.Normalize.Format, Err: err, Body: contents}
+	}
+	slog.Debug("normalized source", "src", src.Name, "format", src.Normalize.Format, "size", len(contents), "normalizedSize", len(normalized))
+	return bytes.NewReader(normalized), nil
+}
+
+// notBefore returns the moment before which src shouldn't be fetched again according to result, see
+// PollPolicy.UseMaxAge. It's the zero time if there is no such moment.
+func (c *Collector) notBefore(src *Source, result *FetchResult) time.Time {
+	if !src.Poll.UseMaxAge || result == nil || result.MaxAge <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(src.Poll.hint(result.MaxAge))
+}
+
+// checkSanity returns body as is if src has no SanityPolicy. Otherwise, it reads body into memory and checks it
+// against the policy, where prevSize is the size of the previous snapshot. Contents that fail result in a
+// *SanityError.
+func (c *Collector) checkSanity(src *Source, body io.Reader, prevSize int64) (io.Reader, error) {
+	if src.Sanity == nil {
+		return body, nil
+	}
+	contents, err := util.ReadAtMost(body, src.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := src.Sanity.Check(src.URL, contents, prevSize); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(contents), nil
+}
+
+// markSeen records that src was seen unchanged just now, and shouldn't be fetched again before notBefore. If result is
+// given, its validators are remembered as well.
+func (c *Collector) markSeen(ctx context.Context, src *Source, result *FetchResult, notBefore time.Time) {
+	if err := c.state.Update(ctx, src.Name, func(st *SourceState) {
+		st.LastSeen = time.Now()
+		st.NotBefore = notBefore
+		if result != nil {
+			st.ETag = result.ETag
+			st.LastModified = result.LastModified
+		}
+	}); err != nil {
+		slog.Error("failed saving collector state", "err", err, "src", src.Name)
+	}
+}
+
+// vim: cc=120:
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunOnceRetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("retry-after", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cfg := &Config{Sources: []*Source{{Name: "busy", URL: srv.URL}}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	state, err := LoadStateStore(dir)
+	if err != nil {
+		t.Fatalf("loading state failed: %v", err)
+	}
+	c, err := NewCollector(cfg, dir, state, time.Second)
+	if err != nil {
+		t.Fatalf("creating collector failed: %v", err)
+	}
+
+	// The source asks to wait an hour, which a single run doesn't
+	done := make(chan struct{})
+	go func() {
+		c.Run(context.Background(), true)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Run didn't return, it waits for Retry-After")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("source was requested %d times, want once", n)
+	}
+	if wait := time.Until(state.Get("busy").NotBefore); wait < 59*time.Minute || wait > time.Hour {
+		t.Errorf("source isn't fetched again for %v, want an hour", wait)
+	}
+}
+
+// vim: cc=120:
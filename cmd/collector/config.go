@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that is written as a string in JSON, e.g. "5m" or "23s" (see time.ParseDuration).
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"5m\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config describes all sources a single collector process fetches. It's read from a JSON file, see LoadConfig. An
+// example:
+//
+//	{
+//		"Workers": 4,
+//		"Sources": [
+//			{
+//				"Name": "vierdaagse",
+//				"URL": "https://example.org/api/everything.json",
+//				"Interval": "5m",
+//				"Jitter": "23s",
+//				"Storage": "vierdaagse",
+//				"ExpectContentType": "application/json",
+//				"Accept": "application/json",
+//				"Normalize": {"Format": "json", "IgnorePaths": ["generatedAt"]},
+//				"Retention": {"KeepLast": 10, "KeepHourly": 24, "KeepDaily": 30},
+//				"Poll": {
+//					"UseMaxAge": true,
+//					"HotWindows": [{"Start": "2026-07-17T00:00:00+02:00", "End": "2026-07-25T00:00:00+02:00", "Interval": "1m"}],
+//					"RecentChange": "2h", "RecentChangeInterval": "2m",
+//					"Idle": "168h", "IdleInterval": "1h"
+//				},
+//				"Hooks": [
+//					{"Exec": ["/usr/local/bin/render-schedule"], "Timeout": "2m"},
+//					{"Webhook": "http://localhost:8080/changed"}
+//				],
+//				"Sanity": {
+//					"MinBytes": 100000,
+//					"MaxShrinkPercent": 25,
+//					"MinCounts": {"Programs": 100, "Locations": 20, "Days": 4},
+//					"AlertHooks": [{"Webhook": "http://localhost:8080/alert"}]
+//				}
+//			},
+//			{
+//				"Name": "thiemeloods",
+//				"URL": "https://example.org/calendar.xml",
+//				"Schedule": [
+//					{"From": "2026-07-17", "Until": "2026-07-24", "Every": "15m"},
+//					{"Cron": "0 8-20/4 * * *"}
+//				],
+//				"Storage": "thiemeloods",
+//				"Normalize": {"Format": "ical"},
+//				"BasicAuth": {"User": "collector", "Pass": "secret"},
+//				"Transport": {"CAFile": "/etc/apploos/ca.pem", "MinTLSVersion": "1.2"}
+//			},
+//			{
+//				"Name": "doornroosje",
+//				"URL": "https://example.org/graphql",
+//				"Interval": "30m",
+//				"Storage": "doornroosje",
+//				"BearerToken": {"File": "/etc/apploos/doornroosje.token"},
+//				"Headers": {"X-Api-Version": "2"},
+//				"Body": {"ContentType": "application/json", "Data": "{\"query\": \"{ events { id title start } }\"}"}
+//			},
+//			{
+//				"Name": "lindenberg",
+//				"URL": "https://example.org/api/events?limit=50",
+//				"Interval": "1h",
+//				"Storage": "lindenberg",
+//				"Pagination": {"Mode": "cursor", "NextPath": "meta.next", "Param": "after", "ItemsPath": "data"}
+//			},
+//			{
+//				"Name": "valkhof",
+//				"URL": "exec:///usr/local/bin/scrape-valkhof",
+//				"Args": ["--format", "json"],
+//				"Interval": "1h",
+//				"Timeout": "10m",
+//				"Storage": "valkhof",
+//				"Normalize": {"Format": "json"}
+//			}
+//		]
+//	}
+type Config struct {
+	// Workers is the maximum number of sources that are fetched concurrently. Defaults to -workers.
+	Workers int
+	Sources []*Source
+}
+
+// LoadConfig reads the JSON configuration in fn. Unknown fields are refused, such that typos don't go unnoticed. The
+// returned Config isn't validated yet, see Config.Validate.
+func LoadConfig(fn string) (*Config, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		slog.Error("cannot open config", "err", err, "fn", fn)
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &Config{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		slog.Error("cannot decode config", "err", err, "fn", fn)
+		return nil, fmt.Errorf("decoding config %q failed: %v", fn, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the Config for consistency and fills in defaults for the fields that weren't given, from the
+// corresponding command line flags.
+func (cfg *Config) Validate() error {
+	if cfg.Workers <= 0 {
+		cfg.Workers = *workers
+	}
+	if cfg.Workers <= 0 {
+		return fmt.Errorf("at least one worker is needed, got %d", cfg.Workers)
+	}
+	if len(cfg.Sources) == 0 {
+		return fmt.Errorf("no sources configured")
+	}
+
+	names := make(map[string]struct{})
+	stdinSources := 0
+	for i, src := range cfg.Sources {
+		if src == nil {
+			return fmt.Errorf("source #%d is empty", i)
+		}
+		if strings.HasPrefix(src.URL, "stdin://") {
+			if stdinSources++; stdinSources > 1 {
+				return fmt.Errorf("source #%d: only a single stdin:// source is supported", i)
+			}
+		}
+		if src.Name == "" {
+			src.Name = src.URL
+		}
+		if _, ok := names[src.Name]; ok {
+			return fmt.Errorf("source #%d: duplicate name %q", i, src.Name)
+		}
+		names[src.Name] = struct{}{}
+
+		if err := src.Validate(); err != nil {
+			return fmt.Errorf("source #%d (%s): %v", i, src.Name, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the Source for consistency and fills in defaults from the command line flags. The fields that are
+// specific to the protocol of the source are validated by its Protocol.
+func (s *Source) Validate() error {
+	protocol, err := IsSupportedSource(s.URL)
+	if err != nil {
+		return err
+	}
+	if s.Interval == 0 {
+		s.Interval = Duration(*refreshInterval)
+	}
+	if s.Interval < 0 {
+		return fmt.Errorf("negative interval %v", time.Duration(s.Interval))
+	}
+	if s.Jitter == nil {
+		jitter := Duration(*refreshJitter)
+		s.Jitter = &jitter
+	}
+	if *s.Jitter < 0 {
+		return fmt.Errorf("negative jitter %v", time.Duration(*s.Jitter))
+	}
+	if s.ExpectContentType == "" {
+		s.ExpectContentType = *expectType
+	}
+	if s.MaxSize == 0 {
+		s.MaxSize = *maxSize
+	}
+	if s.Retry.Attempts == 0 {
+		s.Retry.Attempts = *retries
+	}
+	if s.Retry.Backoff.Base == 0 {
+		s.Retry.Backoff.Base = Duration(*retryBase)
+	}
+	if s.Retry.Backoff.Max == 0 {
+		s.Retry.Backoff.Max = Duration(*retryMax)
+	}
+	if s.Retry.Backoff.Base < 0 || s.Retry.Backoff.Max < s.Retry.Backoff.Base {
+		return fmt.Errorf("invalid retry policy %+v", s.Retry)
+	}
+	if s.Breaker.Threshold == 0 {
+		s.Breaker.Threshold = *breakerThreshold
+	}
+	if s.Breaker.MaxInterval == 0 {
+		s.Breaker.MaxInterval = Duration(*breakerMaxInterval)
+	}
+	if s.Retention.KeepLast == 0 {
+		s.Retention.KeepLast = *keepLast
+	}
+	if s.Retention.KeepHourly == 0 {
+		s.Retention.KeepHourly = *keepHourly
+	}
+	if s.Retention.KeepDaily == 0 {
+		s.Retention.KeepDaily = *keepDaily
+	}
+	if s.Poll.MaxHint == 0 {
+		s.Poll.MaxHint = s.Breaker.MaxInterval
+	}
+	if err := s.Poll.Validate(); err != nil {
+		return err
+	}
+	if len(s.Schedule) > 0 {
+		if len(s.Poll.HotWindows) > 0 || s.Poll.RecentChange > 0 || s.Poll.Idle > 0 {
+			return fmt.Errorf("schedule cannot be combined with hot windows, recent change or idle polling")
+		}
+		if err := s.Schedule.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.Storage != "" {
+		cleaned := filepath.Clean(s.Storage)
+		if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("storage %q must be a subdirectory of -storage", s.Storage)
+		}
+		s.Storage = cleaned
+	}
+	if s.Normalize != nil {
+		if err := s.Normalize.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.Sanity != nil {
+		if err := s.Sanity.Validate(); err != nil {
+			return err
+		}
+	}
+	for i, hook := range s.Hooks {
+		if hook == nil {
+			return fmt.Errorf("hook #%d is empty", i)
+		}
+		if err := hook.Validate(); err != nil {
+			return fmt.Errorf("hook #%d: %v", i, err)
+		}
+	}
+	if s.Timeout == 0 {
+		s.Timeout = Duration(*fetchTimeout)
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("negative timeout %v", time.Duration(s.Timeout))
+	}
+	return validateProtocol(s, protocol)
+}
+
+// vim: cc=120:
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSourceValidateJitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   time.Duration
+	}{
+		{"default", `{"URL": "https://example.org/", "Interval": "5m"}`, *refreshJitter},
+		{"explicit", `{"URL": "https://example.org/", "Interval": "5m", "Jitter": "10s"}`, 10 * time.Second},
+		{"off", `{"URL": "https://example.org/", "Interval": "5m", "Jitter": "0s"}`, 0},
+		// Jitter that is too large for the interval is limited, rather than refused
+		{"large", `{"URL": "https://example.org/", "Interval": "5m", "Jitter": "1h"}`, 150 * time.Second},
+	}
+	for _, test := range tests {
+		src := &Source{}
+		if err := json.Unmarshal([]byte(test.source), src); err != nil {
+			t.Fatalf("%s: decoding source failed: %v", test.name, err)
+		}
+		if err := src.Validate(); err != nil {
+			t.Errorf("%s: Validate failed: %v", test.name, err)
+			continue
+		}
+		if got := src.JitterFor(time.Duration(src.Interval)); got != test.want {
+			t.Errorf("%s: jitter is %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	src := &Source{URL: "https://example.org/", Jitter: new(Duration)}
+	*src.Jitter = Duration(-time.Second)
+	if err := src.Validate(); err == nil {
+		t.Errorf("negative jitter is valid, want error")
+	}
+}
+
+// vim: cc=120:
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		// 2025-06-01 is a Sunday. With both day fields restricted, either one matching is enough.
+		{"0 0 13 * 1", localTime(2025, 6, 1, 0, 0), localTime(2025, 6, 2, 0, 0)},
+		{"0 0 13 * 1", localTime(2025, 6, 9, 0, 0), localTime(2025, 6, 13, 0, 0)},
+		{"0 0 13 * 1", localTime(2025, 6, 13, 0, 0), localTime(2025, 6, 16, 0, 0)},
+		// With a single day field restricted, only that one counts
+		{"0 12 13 * *", localTime(2025, 6, 1, 0, 0), localTime(2025, 6, 13, 12, 0)},
+		{"30 8 * * mon-fri", localTime(2025, 6, 6, 9, 0), localTime(2025, 6, 9, 8, 30)},
+		{"0 0 * * 7", localTime(2025, 6, 2, 0, 0), localTime(2025, 6, 8, 0, 0)},
+		{"0 0 * * SUN", localTime(2025, 6, 2, 0, 0), localTime(2025, 6, 8, 0, 0)},
+		{"0 0 1 jul *", localTime(2025, 6, 2, 0, 0), localTime(2025, 7, 1, 0, 0)},
+		// Steps
+		{"*/15 * * * *", localTime(2025, 6, 1, 10, 0), localTime(2025, 6, 1, 10, 15)},
+		{"5/15 * * * *", localTime(2025, 6, 1, 10, 50), localTime(2025, 6, 1, 11, 5)},
+		{"0 9-17/4 * * *", localTime(2025, 6, 1, 13, 0), localTime(2025, 6, 1, 17, 0)},
+		{"0,30 * * * *", localTime(2025, 6, 1, 10, 10), localTime(2025, 6, 1, 10, 30)},
+		// Macros
+		{"@hourly", localTime(2025, 6, 1, 10, 30), localTime(2025, 6, 1, 11, 0)},
+		{"@daily", localTime(2025, 6, 1, 10, 30), localTime(2025, 6, 2, 0, 0)},
+		{"@midnight", localTime(2025, 6, 1, 10, 30), localTime(2025, 6, 2, 0, 0)},
+		{"@Weekly", localTime(2025, 6, 2, 10, 30), localTime(2025, 6, 8, 0, 0)},
+		{"@monthly", localTime(2025, 6, 1, 10, 30), localTime(2025, 7, 1, 0, 0)},
+		{"@yearly", localTime(2025, 6, 1, 10, 30), localTime(2026, 1, 1, 0, 0)},
+		{"@annually", localTime(2025, 6, 1, 10, 30), localTime(2026, 1, 1, 0, 0)},
+		// The next match is strictly after the given time, and seconds are ignored
+		{"30 10 * * *", localTime(2025, 6, 1, 10, 30), localTime(2025, 6, 2, 10, 30)},
+		{"30 10 * * *", localTime(2025, 6, 1, 10, 29).Add(59 * time.Second), localTime(2025, 6, 1, 10, 30)},
+		// Leap days, and days that never come
+		{"0 0 29 2 *", localTime(2025, 1, 1, 0, 0), localTime(2028, 2, 29, 0, 0)},
+		{"0 0 30 2 *", localTime(2025, 1, 1, 0, 0), time.Time{}},
+		{"0 0 31 4 *", localTime(2025, 1, 1, 0, 0), time.Time{}},
+	}
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q) failed: %v", test.expr, err)
+			continue
+		}
+		if got := c.Next(test.after); !got.Equal(test.want) {
+			t.Errorf("%q.Next(%v) = %v, want %v", test.expr, test.after, got, test.want)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@reboot",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"* * * foo *",
+		"* * * * mon-sun",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+// vim: cc=120:
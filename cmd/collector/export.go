@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/mrngm/apploos/util"
+)
+
+// export implements the export subcommand: it copies the snapshots of every configured source into a tar archive (see
+// util.TarStore), e.g. to ship them to another machine. Snapshots the archive has already are skipped, so an existing
+// archive is updated.
+func export(args []string) int {
+	exportFlags := subcommandFlags("export")
+	archive := exportFlags.String("archive", "", "Copy the snapshots into this tar archive")
+	exportFlags.Parse(args)
+	logger := setupLogger()
+
+	if *saveDir == "" || *archive == "" {
+		logger.Error("please provide -storage and -archive to export")
+		return 1
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Error("invalid configuration", "err", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	dst := util.NewTarStore(*archive, *cleanupTmp)
+	exitCode := 0
+	for _, src := range cfg.Sources {
+		store := util.NewFSStore(filepath.Join(*saveDir, src.Storage), *cleanupTmp)
+		// Keep the collector from pruning snapshots while they're copied
+		lock, err := store.LockShared(ctx, true)
+		if err != nil {
+			logger.Error("cannot lock snapshots", "err", err, "src", src.Name)
+			exitCode = 1
+			continue
+		}
+		copied, err := util.CopySnapshots(ctx, dst, store, src.Name)
+		if err := lock.Release(); err != nil {
+			logger.Error("releasing snapshot lock failed", "err", err, "src", src.Name)
+		}
+		if err != nil {
+			logger.Error("exporting snapshots failed", "err", err, "src", src.Name, "archive", *archive)
+			exitCode = 1
+			continue
+		}
+		logger.Info("exported snapshots", "src", src.Name, "copied", copied, "archive", *archive)
+	}
+	return exitCode
+}
+
+// vim: cc=120:
@@ -2,58 +2,184 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
 	"strings"
 	"time"
+
+	"github.com/mrngm/apploos/util"
 )
 
-var (
-	SupportedProtocols = []string{
-		"http://", "https://", "file://",
+// ErrNotModified is returned when the source indicated it didn't change since the previous fetch, e.g. through an HTTP
+// 304 Not Modified response to a conditional request.
+var ErrNotModified = errors.New("source not modified")
+
+// FetchResult is the outcome of a successful fetch. The caller must close Body. Along with ErrNotModified, a
+// FetchResult without Body may be returned, which describes the response.
+type FetchResult struct {
+	Body io.ReadCloser
+
+	// ETag and LastModified are the validators the source sent along, if any. They should be remembered (see
+	// SourceState) once Body is stored, such that the next fetch can be conditional.
+	ETag         string
+	LastModified string
+
+	// RequestId, StatusCode, Status and Header describe the response, if the protocol has such a notion. They end up
+	// in the snapshot metadata (see util.SnapshotMeta).
+	RequestId  string
+	StatusCode int
+	Status     string
+	Header     http.Header
+
+	// MaxAge is the remaining freshness lifetime of the response, see PollPolicy.UseMaxAge. It's 0 if the source didn't
+	// say.
+	MaxAge time.Duration
+
+	// Timings break down the duration of the request, if the protocol is HTTP. They're complete once Body was read or
+	// closed.
+	Timings *util.HTTPTimings
+}
+
+// Fetcher fetches a single source. It's built once per source by the Protocol of the source, and reused for every
+// fetch of it. Fetch returns a FetchResult and nil error on success, or an appropriate error otherwise. If prev holds
+// validators of an earlier fetch, a conditional request is made where the protocol supports it, and ErrNotModified is
+// returned if the source didn't change. Responses that were received, but rejected, result in a RejectedError.
+//
+// A Fetcher that holds resources, e.g. idle connections, may implement io.Closer, which is called once the source is
+// stopped. A Fetcher that can notice changes of its source implements Watcher.
+type Fetcher interface {
+	Fetch(ctx context.Context, prev SourceState) (*FetchResult, error)
+}
+
+// FetcherFunc adapts an ordinary function to a Fetcher.
+type FetcherFunc func(ctx context.Context, prev SourceState) (*FetchResult, error)
+
+func (f FetcherFunc) Fetch(ctx context.Context, prev SourceState) (*FetchResult, error) {
+	return f(ctx, prev)
+}
+
+// Watcher is implemented by Fetchers whose source can be watched, see Source.Watch. Watch polls the source every
+// interval and notifies the returned channel whenever it changed. The channel is closed when ctx is done.
+type Watcher interface {
+	Watch(ctx context.Context, interval time.Duration) (<-chan struct{}, error)
+}
+
+// Protocol is a kind of source, identified by the prefix of its URL, e.g. "https://". Every protocol registers itself
+// with RegisterProtocol.
+type Protocol struct {
+	// Usage describes the protocol in a single line, for -help.
+	Usage string
+	// Fields are the names of the Source fields that configure sources of this protocol. Sources of protocols that
+	// don't list a field must leave it empty.
+	Fields []string
+	// Validate, if given, checks the configuration of src that is specific to the protocol, and fills in its
+	// defaults. It's called after the other fields of src are validated.
+	Validate func(src *Source) error
+	// New returns the Fetcher of src, which is validated already.
+	New func(src *Source) (Fetcher, error)
+}
+
+// protocols maps the prefix of every registered Protocol to it.
+var protocols = make(map[string]*Protocol)
+
+// RegisterProtocol makes p available for sources whose URL starts with prefix, which must end in "://". It's meant to
+// be called from an init function, and panics if prefix is registered already or p is incomplete.
+func RegisterProtocol(prefix string, p *Protocol) {
+	if !strings.HasSuffix(prefix, "://") {
+		panic(fmt.Sprintf("protocol prefix %q doesn't end in ://", prefix))
 	}
-)
+	if _, ok := protocols[prefix]; ok {
+		panic(fmt.Sprintf("protocol %q registered twice", prefix))
+	}
+	if p == nil || p.New == nil {
+		panic(fmt.Sprintf("protocol %q cannot build fetchers", prefix))
+	}
+	for _, name := range p.Fields {
+		if _, ok := reflect.TypeOf(Source{}).FieldByName(name); !ok {
+			panic(fmt.Sprintf("protocol %q refers to unknown source field %q", prefix, name))
+		}
+	}
+	protocols[prefix] = p
+}
+
+// Protocols returns the prefixes of the registered protocols, sorted.
+func Protocols() []string {
+	ret := make([]string, 0, len(protocols))
+	for prefix := range protocols {
+		ret = append(ret, prefix)
+	}
+	sort.Strings(ret)
+	return ret
+}
 
 // IsSupportedSource returns the protocol and nil error if the given src is supported, or an appropriate message in
 // error otherwise.
 func IsSupportedSource(src string) (string, error) {
-	if !strings.Contains(src, "://") {
+	i := strings.Index(src, "://")
+	if i < 0 {
 		return "", fmt.Errorf("no protocol found, missing :// in %q", src)
 	}
+	if _, ok := protocols[src[:i+3]]; !ok {
+		return "", fmt.Errorf("unsupported source protocol for value %q, supported are %+q", src, Protocols())
+	}
+	return src[:i+3], nil
+}
 
-	for _, proto := range SupportedProtocols {
-		if strings.HasPrefix(src, proto) {
-			return proto, nil
+// validateProtocol checks that src only uses the fields of its own protocol, and validates those.
+func validateProtocol(src *Source, protocol string) error {
+	p := protocols[protocol]
+	v := reflect.ValueOf(src).Elem()
+	for _, other := range Protocols() {
+		for _, name := range protocols[other].Fields {
+			if slices.Contains(p.Fields, name) || v.FieldByName(name).IsZero() {
+				continue
+			}
+			var supported []string
+			for _, prefix := range Protocols() {
+				if slices.Contains(protocols[prefix].Fields, name) {
+					supported = append(supported, prefix)
+				}
+			}
+			return fmt.Errorf("%s is only supported for %s sources", name, strings.Join(supported, ", "))
 		}
 	}
+	if p.Validate != nil {
+		return p.Validate(src)
+	}
+	return nil
+}
 
-	return "", fmt.Errorf("unsupported source protocol for value %q", src)
+// NewFetcher returns the Fetcher of src, which must be validated already.
+func NewFetcher(src *Source) (Fetcher, error) {
+	protocol, err := IsSupportedSource(src.URL)
+	if err != nil {
+		return nil, err
+	}
+	return protocols[protocol].New(src)
 }
 
-// FetchSource tries to fetch the supplied src. It returns an io.ReadCloser and nil error on success, or an appropriate
-// error message otherwise.
-func FetchSource(ctx context.Context, src string) (io.ReadCloser, error) {
+// FetchSource fetches src once with f, see Fetcher. If f is nil, a Fetcher is built for this fetch only (see
+// NewFetcher). A panicking Fetcher results in an error.
+func FetchSource(ctx context.Context, src *Source, f Fetcher, prev SourceState) (result *FetchResult, err error) {
 	defer func() {
 		if p := recover(); p != nil {
-			slog.Error("FetchSource panicked", "src", src, "panic", p)
+			slog.Error("FetchSource panicked", "src", src.URL, "panic", p)
+			result, err = nil, fmt.Errorf("FetchSource panicked: %v", p)
 		}
 	}()
 
-	protocol, err := IsSupportedSource(src)
-	if err != nil {
-		return nil, err
-	}
-
-	switch protocol {
-	case "http://", "https://":
-		fetcher := NewHTTPFetcher(4 * time.Minute)
-		return fetcher.Fetch(ctx, src)
-	case "file://":
-		return nil, fmt.Errorf("unimplemented")
+	if f == nil {
+		if f, err = NewFetcher(src); err != nil {
+			return nil, err
+		}
 	}
-
-	return nil, fmt.Errorf("protocol %q seemed supported, but implementation is missing", protocol)
+	return f.Fetch(ctx, prev)
 }
 
 // vim: cc=120:
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// RejectedError is implemented by errors for responses that were received fine, but are not fit for storing. The
+// collector keeps the (beginning of the) rejected body in quarantine, such that it can be inspected later on.
+type RejectedError interface {
+	error
+	// Rejected returns a short, filename-safe reason (e.g. "status-503") and the body that was rejected.
+	Rejected() (reason string, body []byte)
+}
+
+// HTTPStatusError is returned when a source responds with a status code other than 2xx, or 304 for conditional
+// requests. RetryAfter is the delay a 429 Too Many Requests or 503 Service Unavailable response asked for, if any.
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+	Body       []byte
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %q for %s", e.Status, e.URL)
+}
+
+func (e *HTTPStatusError) Rejected() (string, []byte) {
+	return "status-" + strconv.Itoa(e.StatusCode), e.Body
+}
+
+// ContentTypeError is returned when the Content-Type of a response doesn't match the expected media type of a source,
+// e.g. when an HTML challenge page is served instead of JSON.
+type ContentTypeError struct {
+	URL      string
+	Expected string
+	Got      string
+	Body     []byte
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("unexpected content-type %q for %s, expected %q", e.Got, e.URL, e.Expected)
+}
+
+func (e *ContentTypeError) Rejected() (string, []byte) {
+	return "content-type", e.Body
+}
+
+// EmptyBodyError is returned when a source responds successfully, but without any content.
+type EmptyBodyError struct {
+	URL string
+}
+
+func (e *EmptyBodyError) Error() string {
+	return fmt.Sprintf("empty body for %s", e.URL)
+}
+
+func (e *EmptyBodyError) Rejected() (string, []byte) {
+	return "empty", nil
+}
+
+// NormalizeError is returned when the contents of a source cannot be normalized, e.g. when a JSON source returns
+// invalid JSON.
+type NormalizeError struct {
+	URL    string
+	Format string
+	Err    error
+	Body   []byte
+}
+
+func (e *NormalizeError) Error() string {
+	return fmt.Sprintf("cannot normalize %s as %s: %v", e.URL, e.Format, e.Err)
+}
+
+func (e *NormalizeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *NormalizeError) Rejected() (string, []byte) {
+	return "normalize-" + e.Format, e.Body
+}
+
+// vim: cc=120:
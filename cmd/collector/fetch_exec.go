@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrngm/apploos/util"
+)
+
+func init() {
+	RegisterProtocol("exec://", &Protocol{
+		Usage:  "Run a command without a shell and take its standard output, see Args",
+		Fields: []string{"Args"},
+		Validate: func(src *Source) error {
+			_, err := ParseExecSource(src.URL)
+			return err
+		},
+		New: func(src *Source) (Fetcher, error) {
+			ef := NewExecFetcher(time.Duration(src.Timeout), src.MaxSize)
+			return FetcherFunc(func(ctx context.Context, _ SourceState) (*FetchResult, error) {
+				return ef.Fetch(ctx, src.URL, src.Args, []string{"APPLOOS_SOURCE=" + src.Name})
+			}), nil
+		},
+	})
+	RegisterProtocol("stdin://", &Protocol{
+		Usage: "Read standard input, only with -once",
+		Validate: func(src *Source) error {
+			if src.URL != "stdin://" {
+				return fmt.Errorf("stdin:// source %q cannot have a path", src.URL)
+			}
+			if !*once {
+				return fmt.Errorf("standard input can only be read once, stdin:// sources need -once")
+			}
+			return nil
+		},
+		New: func(src *Source) (Fetcher, error) {
+			return FetcherFunc(func(ctx context.Context, _ SourceState) (*FetchResult, error) {
+				return FetchStdin(ctx, src.MaxSize)
+			}), nil
+		},
+	})
+}
+
+// MaxExecStderrSize is the number of bytes of the standard error of an exec:// source that is kept for logging.
+const MaxExecStderrSize = 4 << 10
+
+// ExecError is returned when the command of an exec:// source fails, e.g. exits with a non-zero status. What it wrote
+// to its standard output is quarantined, as it may be incomplete.
+type ExecError struct {
+	URL    string
+	Err    error
+	Stderr []byte
+	Body   []byte
+}
+
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("running %s failed: %v, stderr: %q", e.URL, e.Err, e.Stderr)
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ExecError) Rejected() (string, []byte) {
+	return "exec", e.Body
+}
+
+// ParseExecSource validates src (protocol: exec://) and returns the command it refers to: either an absolute path, or
+// the name of a command in $PATH, e.g. exec:///usr/local/bin/scrape-agenda or exec://scrape-agenda. Relative paths are
+// refused, as they'd depend on the working directory of the collector.
+func ParseExecSource(src string) (string, error) {
+	name, ok := strings.CutPrefix(src, "exec://")
+	if !ok {
+		return "", fmt.Errorf("invalid prefix, expected exec://")
+	}
+	if name == "" {
+		return "", fmt.Errorf("no command in %q", src)
+	}
+	if !filepath.IsAbs(name) && strings.ContainsRune(name, filepath.Separator) {
+		return "", fmt.Errorf("command in %q must be an absolute path or a name in $PATH", src)
+	}
+	return name, nil
+}
+
+// cappedBuffer keeps the first max bytes written to it, and silently discards the rest. The buffer isn't embedded, as
+// its ReadFrom would bypass Write when copying.
+type cappedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// limitedBuffer refuses to hold more than max bytes (or an unlimited amount if max <= 0). Once a write fails, the
+// command writing to it gets a broken pipe.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	max      int64
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.max > 0 && int64(b.buf.Len()+len(p)) > b.max {
+		b.exceeded = true
+		return 0, fmt.Errorf("output holds more than %d bytes: %w", b.max, util.ErrMaxSizeExceeded)
+	}
+	return b.buf.Write(p)
+}
+
+// ExecFetcher runs a command (protocol: exec://) and takes what it writes to its standard output as the contents of
+// the source, e.g. for a script that scrapes a website. The command is run without a shell, and is killed once timeout
+// passes (unless it's 0). Its standard output is kept in memory, up to maxSize bytes (unlimited when <= 0), as the
+// contents are only valid once the command exited successfully.
+type ExecFetcher struct {
+	timeout time.Duration
+	maxSize int64
+}
+
+func NewExecFetcher(timeout time.Duration, maxSize int64) *ExecFetcher {
+	return &ExecFetcher{
+		timeout: timeout,
+		maxSize: maxSize,
+	}
+}
+
+// Fetch runs the command referred to by src with args, and the environment of the collector extended with env. It
+// returns the standard output as the Body of a FetchResult and nil error if the command succeeded. A command that
+// fails results in an *ExecError, one that outputs nothing in an *EmptyBodyError. If the command is killed because it
+// took too long, the error wraps context.DeadlineExceeded, such that it's retried.
+func (ef *ExecFetcher) Fetch(ctx context.Context, src string, args []string, env []string) (*FetchResult, error) {
+	name, err := ParseExecSource(src)
+	if err != nil {
+		return nil, err
+	}
+	if ef.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ef.timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), env...)
+	// Don't wait forever for children of the command that keep its output open
+	cmd.WaitDelay = time.Second
+	stdout := &limitedBuffer{max: ef.maxSize}
+	stderr := &cappedBuffer{max: MaxExecStderrSize}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	start := time.Now()
+	err = cmd.Run()
+	body := stdout.buf.Bytes()
+	if stdout.exceeded {
+		return nil, fmt.Errorf("output of %s holds more than %d bytes: %w", src, ef.maxSize, util.ErrMaxSizeExceeded)
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("running %s failed after %v: %w", src, time.Since(start), ctxErr)
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) && !errors.Is(err, exec.ErrWaitDelay) {
+			slog.Error("ExecFetcher cannot run command", "err", err, "src", src)
+			return nil, err
+		}
+		return nil, &ExecError{URL: src, Err: err, Stderr: stderr.buf.Bytes(), Body: body}
+	}
+	slog.Info("ran command", "src", src, "size", len(body), "duration", time.Since(start), "stderr", stderr.buf.String())
+	if len(body) == 0 {
+		return nil, &EmptyBodyError{URL: src}
+	}
+	return &FetchResult{Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+// stdinRead tells whether the stdin:// source was fetched already.
+var stdinRead atomic.Bool
+
+// FetchStdin reads the standard input of the collector (protocol: stdin://), up to maxSize bytes (unlimited when <=
+// 0), and returns it as the Body of a FetchResult and nil error. It's meant for piping contents into a collector that
+// runs with -once, e.g. generate-agenda | collector -once -source stdin://, so standard input can be read only once.
+// Reading isn't interrupted when ctx is done, it's up to the producer to finish.
+func FetchStdin(ctx context.Context, maxSize int64) (*FetchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !stdinRead.CompareAndSwap(false, true) {
+		return nil, fmt.Errorf("standard input was read already, stdin:// can only be fetched once")
+	}
+	body, err := util.ReadAtMost(os.Stdin, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading standard input failed: %w", err)
+	}
+	slog.Info("read standard input", "size", len(body))
+	if len(body) == 0 {
+		return nil, &EmptyBodyError{URL: "stdin://"}
+	}
+	return &FetchResult{Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+// vim: cc=120:
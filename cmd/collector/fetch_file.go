@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func init() {
+	RegisterProtocol("file://", &Protocol{
+		Usage:  "Read a regular file on the local filesystem, see -followSymlinks",
+		Fields: []string{"Watch"},
+		Validate: func(src *Source) error {
+			_, err := ParseFileSource(src.URL)
+			return err
+		},
+		New: func(src *Source) (Fetcher, error) {
+			return &fileSource{ff: NewFileFetcher(*followSymlinks), url: src.URL}, nil
+		},
+	})
+}
+
+// fileSource is the Fetcher of a file:// source, which can be watched.
+type fileSource struct {
+	ff  *FileFetcher
+	url string
+}
+
+func (s *fileSource) Fetch(ctx context.Context, _ SourceState) (*FetchResult, error) {
+	return s.ff.Fetch(ctx, s.url)
+}
+
+func (s *fileSource) Watch(ctx context.Context, interval time.Duration) (<-chan struct{}, error) {
+	return s.ff.Watch(ctx, s.url, interval)
+}
+
+// FileFetcher reads sources from the local filesystem (protocol: file://), e.g. a calendar export that is dropped on a
+// share. Only regular files are accepted. Symbolic links are refused, unless the FileFetcher is created with
+// followSymlinks.
+type FileFetcher struct {
+	followSymlinks bool
+}
+
+func NewFileFetcher(followSymlinks bool) *FileFetcher {
+	return &FileFetcher{
+		followSymlinks: followSymlinks,
+	}
+}
+
+// ParseFileSource validates src (protocol: file://) and returns the cleaned, absolute path it refers to. Only local
+// files are supported, so the host part must be empty or "localhost". Query strings and fragments are rejected, as they
+// are meaningless for files and most likely indicate a typo.
+func ParseFileSource(src string) (string, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse %q: %v", src, err)
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("invalid prefix, expected file://")
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("non-local host %q in %q, did you mean file:///%s%s?", u.Host, src, u.Host, u.Path)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("query or fragment not supported in %q", src)
+	}
+	if u.Path == "" || !filepath.IsAbs(u.Path) {
+		return "", fmt.Errorf("path in %q must be absolute", src)
+	}
+	return filepath.Clean(u.Path), nil
+}
+
+// resolve returns the path that should be opened for fn. If fn is a symbolic link, it's either resolved (when following
+// symlinks), or an error is returned.
+func (ff *FileFetcher) resolve(fn string) (string, error) {
+	info, err := os.Lstat(fn)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return fn, nil
+	}
+	if !ff.followSymlinks {
+		return "", fmt.Errorf("%q is a symbolic link, refusing to follow (see -followSymlinks)", fn)
+	}
+	target, err := filepath.EvalSymlinks(fn)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve symbolic link %q: %v", fn, err)
+	}
+	slog.Debug("FileFetcher followed symbolic link", "fn", fn, "target", target)
+	return target, nil
+}
+
+// Fetch opens the file referred to by src (protocol: file://) and returns it as the Body of a FetchResult and nil
+// error. Otherwise, an appropriate error is returned.
+//
+// The caller must close the returned Body on nil error.
+func (ff *FileFetcher) Fetch(ctx context.Context, src string) (*FetchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fn, err := ParseFileSource(src)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := ff.resolve(fn)
+	if err != nil {
+		slog.Error("FileFetcher cannot resolve source", "err", err, "src", src)
+		return nil, err
+	}
+	before, err := os.Lstat(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if !before.Mode().IsRegular() {
+		return nil, fmt.Errorf("%q is not a regular file (mode %v)", resolved, before.Mode())
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		slog.Error("FileFetcher open failed", "err", err, "fn", resolved)
+		return nil, err
+	}
+	// Make sure we opened the file we inspected, and not something that was swapped in between Lstat and Open.
+	after, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !os.SameFile(before, after) {
+		f.Close()
+		return nil, fmt.Errorf("%q changed while opening, refusing to read", resolved)
+	}
+	slog.Info("opened file", "fn", resolved, "src", src, "size", after.Size(), "mtime", after.ModTime())
+
+	return &FetchResult{Body: f}, nil
+}
+
+// Watch polls the file referred to by src every interval and notifies the returned channel whenever it changed in
+// size, modification time or identity (e.g. it was replaced through a rename). Notifications are coalesced: if the
+// receiver isn't keeping up, at most one notification is pending. The channel is closed when ctx is done.
+//
+// Missing files are not an error: appearing counts as a change.
+func (ff *FileFetcher) Watch(ctx context.Context, src string, interval time.Duration) (<-chan struct{}, error) {
+	fn, err := ParseFileSource(src)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("watch interval must be positive, got %v", interval)
+	}
+
+	stat := func() os.FileInfo {
+		resolved, err := ff.resolve(fn)
+		if err != nil {
+			return nil
+		}
+		info, err := os.Stat(resolved)
+		if err != nil {
+			return nil
+		}
+		return info
+	}
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := stat()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			cur := stat()
+			if !fileChanged(last, cur) {
+				continue
+			}
+			slog.Debug("FileFetcher noticed change", "fn", fn)
+			last = cur
+			if cur == nil {
+				// Disappeared, nothing to fetch
+				continue
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func fileChanged(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a != b
+	}
+	return !os.SameFile(a, b) || a.Size() != b.Size() || !a.ModTime().Equal(b.ModTime())
+}
+
+// vim: cc=120:
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"net/http/httptrace"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,8 +20,19 @@ import (
 	"github.com/mrngm/apploos/util"
 )
 
+// MaxRejectedBodySize is the number of bytes of a rejected response that is kept for quarantine.
+const MaxRejectedBodySize = 1 << 20
+
 type HTTPFetcher struct {
 	client *http.Client
+	// expectContentType is a comma separated list of acceptable media types, e.g. "application/json" or
+	// "text/calendar, application/xml". A type may end with the wildcard "/*". It's not checked when empty.
+	expectContentType string
+
+	// session, if given, has the client keep cookies, see HTTPSession. loggedIn tells whether the login succeeded.
+	session  *HTTPSession
+	mu       sync.Mutex
+	loggedIn bool
 }
 
 // redirPreventerLogger prevents more than 2 redirects
@@ -32,23 +48,115 @@ func redirPreventerLogger(req *http.Request, via []*http.Request) error {
 	return fmt.Errorf("preventing redirect (after %d earlier request(s)) to %v", len(via), req.URL)
 }
 
-func NewHTTPFetcher(timeout time.Duration) *HTTPFetcher {
+func NewHTTPFetcher(timeout time.Duration, expectContentType string) *HTTPFetcher {
 	return &HTTPFetcher{
 		client: &http.Client{
 			CheckRedirect: redirPreventerLogger,
 			Timeout:       timeout,
 		},
+		expectContentType: expectContentType,
+	}
+}
+
+// CloseIdleConnections closes the connections the fetcher keeps for reuse.
+func (hf *HTTPFetcher) CloseIdleConnections() {
+	hf.client.CloseIdleConnections()
+}
+
+// matchContentType reports whether the Content-Type header value got matches one of the media types in expected (see
+// HTTPFetcher.expectContentType). Media type parameters, such as charset, are ignored.
+func matchContentType(expected, got string) bool {
+	gotType, _, err := mime.ParseMediaType(got)
+	if err != nil {
+		return false
+	}
+	for _, exp := range strings.Split(expected, ",") {
+		exp = strings.ToLower(strings.TrimSpace(exp))
+		if exp == gotType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(exp, "/*"); ok && strings.HasPrefix(gotType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// readRejected reads at most MaxRejectedBodySize bytes of a rejected response body and closes it.
+func readRejected(resp *http.Response) []byte {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxRejectedBodySize))
+	if err != nil {
+		slog.Error("reading rejected response body failed", "err", err, util.Req2slog(resp.Request))
+	}
+	if err := resp.Body.Close(); err != nil {
+		slog.Error("closing rejected response body failed", "err", err, util.Req2slog(resp.Request))
+	}
+	return body
+}
+
+// do sends req, logging in first if the session requires so. If the source refuses the request with 401 Unauthorized
+// or 403 Forbidden, the session might have expired: the login is repeated once, and so is req.
+func (hf *HTTPFetcher) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	hasLogin := hf.session != nil && hf.session.LoginURL != ""
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	justLoggedIn := false
+	if hasLogin && !hf.loggedIn {
+		if err := hf.login(ctx); err != nil {
+			return nil, err
+		}
+		hf.loggedIn, justLoggedIn = true, true
+	}
+
+	// The client adds the cookies of the jar to req itself, so keep a pristine copy for a retry with the new session
+	retry := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("copying request body failed: %v", err)
+		}
+		retry.Body = body
+	}
+	resp, err := hf.client.Do(req)
+	if err != nil {
+		slog.Error("request failed", "err", err, util.Req2slog(req))
+		return nil, err
+	}
+	slog.Info("received response", util.Resp2slog(resp))
+	if !hasLogin || justLoggedIn || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+		return resp, nil
+	}
+
+	slog.Info("session seems expired, logging in again", util.Resp2slog(resp))
+	readRejected(resp)
+	hf.loggedIn = false
+	if err := hf.login(ctx); err != nil {
+		return nil, err
+	}
+	hf.loggedIn = true
+	resp, err = hf.client.Do(retry)
+	if err != nil {
+		slog.Error("request failed", "err", err, util.Req2slog(req))
+		return nil, err
 	}
+	slog.Info("received response", util.Resp2slog(resp))
+	return resp, nil
 }
 
-// FetchHTTPSource retrieves src (protocols: http://, https://) using GET method and returns an io.ReadCloer and nil
-// error.  Otherwise, an appropriate error is returned. It's possible to customize parts of the request using the
-// options.
+// FetchHTTPSource retrieves src (protocols: http://, https://) using GET method (unless WithMethod says otherwise) and
+// returns a FetchResult and nil error.  Otherwise, an appropriate error is returned. It's possible to customize parts
+// of the request using the options. A 304 Not Modified response (see WithIfNoneMatch and WithIfModifiedSince) results
+// in ErrNotModified, along with a FetchResult without Body.
 //
-// The caller must close the returned io.ReadCloser on nil error.
+// Responses that shouldn't be stored result in a RejectedError: an *HTTPStatusError for status codes other than 2xx, a
+// *ContentTypeError if the Content-Type doesn't match the expected content type, and an *EmptyBodyError if the response
+// has no content.
+//
+// The caller must close the returned Body on nil error. The Timings of the request are complete once Body was read or
+// closed.
 //
 // If a request ID couldn't be generated (UUID), this function may panic.
-func (hf *HTTPFetcher) Fetch(ctx context.Context, src string, options ...HTTPFetchOption) (io.ReadCloser, error) {
+func (hf *HTTPFetcher) Fetch(ctx context.Context, src string, options ...HTTPFetchOption) (*FetchResult, error) {
 	// Try to make sense of the provided src
 	if !(strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")) {
 		return nil, fmt.Errorf("invalid prefix, expected http:// or https://")
@@ -56,13 +164,16 @@ func (hf *HTTPFetcher) Fetch(ctx context.Context, src string, options ...HTTPFet
 	if *appname == "" { // flags
 		*appname = "FIXME-to-be-nice"
 	}
-	options = append(options, WithUserAgent(*appname))
+	// Prepend the default user-agent, such that the options may override it
+	options = append([]HTTPFetchOption{WithUserAgent(*appname)}, options...)
 
 	// Generate a request ID (UUID), add it to the request and insert it into the context
 	reqId := uuid.New() // may panic
 	options = append(options, WithRequestIdAndAppname(reqId, *appname))
 
 	ctx = util.NewContextWithRequestId(ctx, reqId)
+	timer := newHTTPTimer()
+	ctx = httptrace.WithClientTrace(ctx, timer.trace())
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
 	if err != nil {
@@ -80,14 +191,80 @@ func (hf *HTTPFetcher) Fetch(ctx context.Context, src string, options ...HTTPFet
 
 	slog.Debug("request created", "request-id", reqId, util.Req2slog(req))
 
-	resp, err := hf.client.Do(req)
+	resp, err := hf.do(ctx, req)
 	if err != nil {
-		slog.Error("request failed", "err", err, util.Req2slog(req))
+		timer.finish(reqId, req)
 		return nil, err
 	}
-	slog.Info("received response", util.Resp2slog(resp))
+	resp.Body = &timedBody{ReadCloser: resp.Body, done: func() { timer.finish(reqId, req) }}
+
+	if resp.StatusCode == http.StatusNotModified {
+		if err := resp.Body.Close(); err != nil {
+			slog.Error("closing 304 response body failed", "err", err, util.Req2slog(req))
+		}
+		return &FetchResult{
+			RequestId:  reqId.String(),
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Header:     resp.Header,
+			MaxAge:     parseMaxAge(resp.Header),
+			Timings:    timer.result,
+		}, ErrNotModified
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retryAfter := time.Duration(0)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			retryAfter = parseRetryAfter(resp.Header.Get("retry-after"), time.Now())
+		}
+		return nil, &HTTPStatusError{
+			URL:        src,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: retryAfter,
+			Body:       readRejected(resp),
+		}
+	}
+	if hf.expectContentType != "" && !matchContentType(hf.expectContentType, resp.Header.Get("content-type")) {
+		return nil, &ContentTypeError{
+			URL:      src,
+			Expected: hf.expectContentType,
+			Got:      resp.Header.Get("content-type"),
+			Body:     readRejected(resp),
+		}
+	}
+	// Peek into the body, such that we can tell it's empty without consuming anything
+	body := bufio.NewReader(resp.Body)
+	if _, err := body.Peek(1); errors.Is(err, io.EOF) {
+		readRejected(resp)
+		return nil, &EmptyBodyError{URL: src}
+	} else if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("reading body of %s failed: %w", src, err)
+	}
 
-	return resp.Body, nil
+	ret := &FetchResult{
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{body, resp.Body},
+		ETag:       resp.Header.Get("etag"),
+		RequestId:  reqId.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     resp.Header,
+		MaxAge:     parseMaxAge(resp.Header),
+		Timings:    timer.result,
+	}
+	// Only remember a Last-Modified we can make sense of, such that the next request doesn't fail on it
+	if lastModified := resp.Header.Get("last-modified"); lastModified != "" {
+		if _, err := http.ParseTime(lastModified); err == nil {
+			ret.LastModified = lastModified
+		} else {
+			slog.Debug("ignoring unparseable last-modified", "err", err, "last-modified", lastModified)
+		}
+	}
+	return ret, nil
 }
 
 // vim: cc=120:
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"strings"
@@ -38,6 +40,82 @@ func WithBasicAuth(user, pass string) HTTPFetchOption {
 	}
 }
 
+// WithBearerToken sets the Authorization header to the bearer token returned by token, which is called for every
+// request, such that a token that is rotated on disk is picked up. The token is never logged.
+func WithBearerToken(token func() (string, error)) HTTPFetchOption {
+	return func(r *http.Request) error {
+		val, err := token()
+		if err != nil {
+			return fmt.Errorf("reading bearer token failed: %v", err)
+		}
+		if val == "" || strings.ContainsAny(val, "\r\n") {
+			return fmt.Errorf("bearer token is empty or contains a newline")
+		}
+		r.Header.Set("authorization", "Bearer "+val)
+		slog.Debug("WithBearerToken", "token", "<redacted>", util.Req2slog(r))
+		return nil
+	}
+}
+
+// WithHeader sets the header name to val, replacing any earlier value. The value isn't logged, as headers such as API
+// keys are secrets.
+func WithHeader(name, val string) HTTPFetchOption {
+	return func(r *http.Request) error {
+		if !isToken(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(val, "\r\n") {
+			return fmt.Errorf("value of header %q contains a newline", name)
+		}
+		r.Header.Set(name, val)
+		slog.Debug("WithHeader", "header", name, util.Req2slog(r))
+		return nil
+	}
+}
+
+// WithMethod sets the request method, e.g. POST instead of the default GET.
+func WithMethod(method string) HTTPFetchOption {
+	return func(r *http.Request) error {
+		if !isToken(method) {
+			return fmt.Errorf("invalid method %q", method)
+		}
+		r.Method = method
+		slog.Debug("WithMethod", "method", method, util.Req2slog(r))
+		return nil
+	}
+}
+
+// WithBody sends body as the request body, with the given Content-Type. The body can be sent again, e.g. after a
+// redirect or a repeated login (see HTTPSession).
+func WithBody(contentType string, body []byte) HTTPFetchOption {
+	return func(r *http.Request) error {
+		if contentType == "" {
+			return fmt.Errorf("body without content type")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		r.ContentLength = int64(len(body))
+		r.Header.Set("content-type", contentType)
+		slog.Debug("WithBody", "content-type", contentType, "size", len(body), util.Req2slog(r))
+		return nil
+	}
+}
+
+// isToken reports whether s is a valid HTTP token (RFC 9110, section 5.6.2), as used in header names and methods.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
 func WithUserAgent(val string) HTTPFetchOption {
 	return func(r *http.Request) error {
 		r.Header.Set("user-agent", val)
@@ -46,6 +124,32 @@ func WithUserAgent(val string) HTTPFetchOption {
 	}
 }
 
+// WithIfNoneMatch makes the request conditional on the entity tag etag, as returned in the ETag header of an earlier
+// response.
+func WithIfNoneMatch(etag string) HTTPFetchOption {
+	return func(r *http.Request) error {
+		if etag == "" {
+			return fmt.Errorf("empty etag")
+		}
+		r.Header.Set("if-none-match", etag)
+		slog.Debug("WithIfNoneMatch", "etag", etag, util.Req2slog(r))
+		return nil
+	}
+}
+
+// WithIfModifiedSince makes the request conditional on the modification time lastModified, as returned in the
+// Last-Modified header of an earlier response.
+func WithIfModifiedSince(lastModified string) HTTPFetchOption {
+	return func(r *http.Request) error {
+		if _, err := http.ParseTime(lastModified); err != nil {
+			return fmt.Errorf("invalid last-modified value %q: %v", lastModified, err)
+		}
+		r.Header.Set("if-modified-since", lastModified)
+		slog.Debug("WithIfModifiedSince", "last-modified", lastModified, util.Req2slog(r))
+		return nil
+	}
+}
+
 func WithRequestIdAndAppname(id uuid.UUID, appname string) HTTPFetchOption {
 	return func(r *http.Request) error {
 		strVal := id.String()
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mrngm/apploos/util"
+)
+
+const (
+	PaginateLink   = "link"
+	PaginateCursor = "cursor"
+	PaginatePage   = "page"
+
+	MergeArray  = "array"
+	MergeBundle = "bundle"
+
+	// DefaultMaxPages is the maximum number of pages that is followed, unless Pagination.MaxPages says otherwise.
+	DefaultMaxPages = 100
+)
+
+// Pagination describes how a source that returns its contents in pages (of JSON) is followed. All pages end up in a
+// single snapshot, such that its checksum covers the complete dataset. Conditional requests aren't made for paginated
+// sources, as an unchanged first page says nothing about the others.
+type Pagination struct {
+	// Mode determines how the next page is found:
+	//
+	// "link" follows the Link header with rel="next" (RFC 8288), until there is none.
+	//
+	// "cursor" takes the value at NextPath in the page. If Param is given, the value is a cursor that is put in that
+	// query parameter of URL; otherwise it's the (possibly relative) URL of the next page. It stops when the value is
+	// missing, null or empty.
+	//
+	// "page" counts the query parameter Param (defaults to "page") up from Start (defaults to 1), until a page has no
+	// items.
+	Mode     string
+	NextPath string `json:",omitempty"`
+	Param    string `json:",omitempty"`
+	Start    *int   `json:",omitempty"`
+	// ItemsPath is the path of the array of items in a page, in the notation of NormalizePolicy.IgnorePaths but
+	// without wildcards. It's empty if the page is the array itself.
+	ItemsPath string `json:",omitempty"`
+	// Merge is either "array" (the default), which concatenates the items of all pages into a single JSON array, or
+	// "bundle", which stores a JSON array of the pages as they are.
+	Merge string `json:",omitempty"`
+	// MaxPages limits the number of pages. A source with more pages is rejected, rather than stored incompletely.
+	// The empty page that ends page counting doesn't count. Defaults to DefaultMaxPages.
+	MaxPages int `json:",omitempty"`
+}
+
+// PaginationError is returned when the pages of a source cannot be followed or merged, e.g. when a page isn't JSON or
+// there are more pages than allowed.
+type PaginationError struct {
+	URL  string
+	Err  error
+	Body []byte
+}
+
+func (e *PaginationError) Error() string {
+	return fmt.Sprintf("cannot paginate %s: %v", e.URL, e.Err)
+}
+
+func (e *PaginationError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PaginationError) Rejected() (string, []byte) {
+	return "pagination", e.Body
+}
+
+// Validate checks the Pagination for consistency and fills in defaults.
+func (p *Pagination) Validate() error {
+	switch p.Mode {
+	case PaginateLink:
+		if p.Param != "" || p.NextPath != "" || p.Start != nil {
+			return fmt.Errorf("pagination mode %q doesn't take a param, next path or start", p.Mode)
+		}
+	case PaginateCursor:
+		if p.NextPath == "" {
+			return fmt.Errorf("pagination mode %q needs a next path", p.Mode)
+		}
+		if p.Start != nil {
+			return fmt.Errorf("pagination mode %q doesn't take a start", p.Mode)
+		}
+	case PaginatePage:
+		if p.NextPath != "" {
+			return fmt.Errorf("pagination mode %q doesn't take a next path", p.Mode)
+		}
+		if p.Param == "" {
+			p.Param = "page"
+		}
+		if p.Start == nil {
+			start := 1
+			p.Start = &start
+		}
+	default:
+		return fmt.Errorf("unsupported pagination mode %q, expected %q, %q or %q", p.Mode, PaginateLink, PaginateCursor, PaginatePage)
+	}
+	switch p.Merge {
+	case "":
+		p.Merge = MergeArray
+	case MergeArray, MergeBundle:
+	default:
+		return fmt.Errorf("unsupported merge %q, expected %q or %q", p.Merge, MergeArray, MergeBundle)
+	}
+	for _, path := range []string{p.NextPath, p.ItemsPath} {
+		if err := validJSONPath(path); err != nil {
+			return err
+		}
+	}
+	if p.MaxPages == 0 {
+		p.MaxPages = DefaultMaxPages
+	}
+	if p.MaxPages < 0 {
+		return fmt.Errorf("negative maximum number of pages %d", p.MaxPages)
+	}
+	return nil
+}
+
+// FetchPages retrieves all pages of src according to p, see Fetch for the options. The pages are merged in memory, up
+// to maxSize bytes (unlimited if maxSize <= 0) of pages in total. The returned FetchResult describes the response of
+// the first page, without validators, and with the Timings of all pages summed.
+func (hf *HTTPFetcher) FetchPages(ctx context.Context, src string, p *Pagination, maxSize int64, options ...HTTPFetchOption) (*FetchResult, error) {
+	next, err := url.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %v", src, err)
+	}
+	page := 0
+	if p.Mode == PaginatePage {
+		page = *p.Start
+		next = withQueryParam(next, p.Param, strconv.Itoa(page))
+	}
+
+	var first *FetchResult
+	timings := &util.HTTPTimings{}
+	var items []any
+	var pages []json.RawMessage
+	seen := make(map[string]struct{})
+	size := int64(0)
+	for next != nil {
+		// In page mode, the page after the last one is fetched to find it empty, so it doesn't count
+		if len(pages) > p.MaxPages || len(pages) == p.MaxPages && p.Mode != PaginatePage {
+			return nil, &PaginationError{URL: src, Err: fmt.Errorf("more than %d pages", p.MaxPages)}
+		}
+		if _, ok := seen[next.String()]; ok {
+			return nil, &PaginationError{URL: src, Err: fmt.Errorf("page %s was seen before", next)}
+		}
+		seen[next.String()] = struct{}{}
+
+		remaining := int64(0)
+		if maxSize > 0 {
+			// ReadAtMost takes 0 as unlimited, and there's no room for another page anyway
+			if remaining = maxSize - size; remaining <= 0 {
+				return nil, fmt.Errorf("pages of %s hold more than %d bytes: %w", src, maxSize, util.ErrMaxSizeExceeded)
+			}
+		}
+		res, err := hf.Fetch(ctx, next.String(), options...)
+		if err != nil {
+			return nil, err
+		}
+		data, err := util.ReadAtMost(res.Body, remaining)
+		if err := res.Body.Close(); err != nil {
+			slog.Error("closing page body failed", "err", err, "url", next)
+		}
+		if res.Timings != nil {
+			timings.Add(*res.Timings)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading page %s failed: %w", next, err)
+		}
+		size += int64(len(data))
+		if first == nil {
+			first = res
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return nil, &PaginationError{URL: src, Err: fmt.Errorf("page %s isn't JSON: %v", next, err), Body: data}
+		}
+		var pageItems []any
+		if p.Merge == MergeArray || p.Mode == PaginatePage {
+			found, _ := lookupJSONPath(v, p.ItemsPath, false)
+			var ok bool
+			if pageItems, ok = found.([]any); !ok {
+				return nil, &PaginationError{URL: src, Err: fmt.Errorf("page %s has no array at %q", next, p.ItemsPath), Body: data}
+			}
+		}
+		// An empty page is where page counting stops, and isn't part of the bundle
+		if p.Mode == PaginatePage && len(pageItems) == 0 {
+			break
+		}
+		items = append(items, pageItems...)
+		pages = append(pages, data)
+		slog.Debug("fetched page", "url", next, "page", len(seen), "items", len(pageItems), "size", len(data))
+
+		current := next
+		switch p.Mode {
+		case PaginateLink:
+			next, err = nextLink(current, res.Header)
+		case PaginateCursor:
+			next, err = nextCursor(current, src, p, v)
+		case PaginatePage:
+			page++
+			next = withQueryParam(current, p.Param, strconv.Itoa(page))
+		}
+		if err != nil {
+			return nil, &PaginationError{URL: src, Err: err, Body: data}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if p.Merge == MergeBundle {
+		err = enc.Encode(pages)
+	} else {
+		if items == nil {
+			items = []any{}
+		}
+		err = enc.Encode(items)
+	}
+	if err != nil {
+		return nil, &PaginationError{URL: src, Err: err}
+	}
+	slog.Info("fetched all pages", "url", src, "pages", len(pages), "items", len(items), "size", buf.Len())
+
+	// The first page determines what the snapshot looks like, but validators of a single page don't apply to the whole
+	first.Body = io.NopCloser(buf)
+	first.ETag, first.LastModified = "", ""
+	first.Timings = timings
+	return first, nil
+}
+
+// validJSONPath checks path in the notation of lookupJSONPath.
+func validJSONPath(path string) error {
+	if strings.Contains(path, "*") || strings.Contains(path, "..") || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") {
+		return fmt.Errorf("invalid path %q", path)
+	}
+	return nil
+}
+
+// lookupJSONPath returns the value at path in v, where path is a dotted path of object keys and array indices, or v
+// itself if path is empty. If foldCase is given, object keys match case-insensitively when there is no exact match,
+// like encoding/json does. Of several keys that match that way, the first in sorted order is taken.
+func lookupJSONPath(v any, path string, foldCase bool) (any, bool) {
+	if path == "" {
+		return v, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch t := v.(type) {
+		case map[string]any:
+			child, ok := t[key]
+			if !ok && foldCase {
+				folded := ""
+				for k := range t {
+					if strings.EqualFold(k, key) && (!ok || k < folded) {
+						child, ok, folded = t[k], true, k
+					}
+				}
+			}
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// withQueryParam returns a copy of u with the query parameter name set to value.
+func withQueryParam(u *url.URL, name, value string) *url.URL {
+	ret := *u
+	query := ret.Query()
+	query.Set(name, value)
+	ret.RawQuery = query.Encode()
+	return &ret
+}
+
+// nextLink returns the target of the Link header with rel="next" in header, resolved against current, or nil if there
+// is none.
+func nextLink(current *url.URL, header http.Header) (*url.URL, error) {
+	for _, value := range header.Values("link") {
+		for _, link := range strings.Split(value, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+			if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				name, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if !strings.EqualFold(name, "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(val, `"`)) {
+					if strings.EqualFold(rel, "next") {
+						ref, err := url.Parse(target[1 : len(target)-1])
+						if err != nil {
+							return nil, fmt.Errorf("invalid next link %q: %v", target, err)
+						}
+						return current.ResolveReference(ref), nil
+					}
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// nextCursor returns the URL of the page after the page v (fetched from current), or nil if it was the last one. See
+// Pagination.Mode for how the cursor is used.
+func nextCursor(current *url.URL, src string, p *Pagination, v any) (*url.URL, error) {
+	found, ok := lookupJSONPath(v, p.NextPath, false)
+	if !ok || found == nil {
+		return nil, nil
+	}
+	var cursor string
+	switch t := found.(type) {
+	case string:
+		cursor = t
+	case json.Number:
+		cursor = t.String()
+	default:
+		return nil, fmt.Errorf("cursor at %q is neither a string nor a number", p.NextPath)
+	}
+	if cursor == "" {
+		return nil, nil
+	}
+	if p.Param == "" {
+		ref, err := url.Parse(cursor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid next URL %q: %v", cursor, err)
+		}
+		return current.ResolveReference(ref), nil
+	}
+	base, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return withQueryParam(base, p.Param, cursor), nil
+}
+
+// vim: cc=120:
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrngm/apploos/util"
+)
+
+// pagedItems are the items the pagination test server serves, pagedSize at a time.
+var pagedItems = []int{1, 2, 3, 4, 5, 6, 7}
+
+const pagedSize = 3
+
+// servePages returns a test server that serves pagedItems in pages, in every pagination mode:
+//
+//	/link?p=1                  [1,2,3] with a Link header to the next page
+//	/cursor?after=0            {"data": [1,2,3], "meta": {"next": 3}}
+//	/cursor-url?after=0        {"data": [1,2,3], "next": "/cursor-url?after=3"}
+//	/page?page=1               {"items": [1,2,3]}, and no items after the last page
+//	/loop                      [1] with a Link header to itself
+//	/html                      <html>
+func servePages(t *testing.T) *httptest.Server {
+	t.Helper()
+	page := func(offset int) []int {
+		if offset >= len(pagedItems) {
+			return []int{}
+		}
+		return pagedItems[offset:min(offset+pagedSize, len(pagedItems))]
+	}
+	writeJSON := func(w http.ResponseWriter, v any) {
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch r.URL.Path {
+		case "/link":
+			p, _ := strconv.Atoi(query.Get("p"))
+			p = max(p, 1)
+			if p*pagedSize < len(pagedItems) {
+				w.Header().Set("link", fmt.Sprintf(`</first>; rel="first", </link?p=%d>; rel="next"`, p+1))
+			}
+			writeJSON(w, page((p-1)*pagedSize))
+		case "/cursor", "/cursor-url":
+			after, _ := strconv.Atoi(query.Get("after"))
+			var next any
+			if after+pagedSize < len(pagedItems) {
+				next = after + pagedSize
+			}
+			if r.URL.Path == "/cursor" {
+				writeJSON(w, map[string]any{"data": page(after), "meta": map[string]any{"next": next}})
+			} else if next != nil {
+				writeJSON(w, map[string]any{"data": page(after), "next": fmt.Sprintf("/cursor-url?after=%d", next)})
+			} else {
+				writeJSON(w, map[string]any{"data": page(after), "next": ""})
+			}
+		case "/page":
+			p, _ := strconv.Atoi(query.Get("page"))
+			writeJSON(w, map[string]any{"items": page((p - 1) * pagedSize)})
+		case "/loop":
+			w.Header().Set("link", `</loop>; rel="next"`)
+			writeJSON(w, []int{1})
+		case "/html":
+			w.Write([]byte("<html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchPages(t *testing.T) {
+	srv := servePages(t)
+	allItems := "[1,2,3,4,5,6,7]"
+	tests := []struct {
+		name    string
+		path    string
+		p       Pagination
+		maxSize int64
+		want    string
+		// wantErr is the error that is expected, if any
+		wantErr error
+	}{
+		{"link", "/link", Pagination{Mode: PaginateLink}, 0, allItems, nil},
+		{"link bundle", "/link", Pagination{Mode: PaginateLink, Merge: MergeBundle}, 0, "[[1,2,3],[4,5,6],[7]]", nil},
+		{"cursor", "/cursor", Pagination{Mode: PaginateCursor, NextPath: "meta.next", Param: "after", ItemsPath: "data"}, 0, allItems, nil},
+		{"cursor url", "/cursor-url", Pagination{Mode: PaginateCursor, NextPath: "next", ItemsPath: "data"}, 0, allItems, nil},
+		{"page", "/page", Pagination{Mode: PaginatePage, ItemsPath: "items"}, 0, allItems, nil},
+		{
+			"page bundle", "/page", Pagination{Mode: PaginatePage, ItemsPath: "items", Merge: MergeBundle}, 0,
+			`[{"items":[1,2,3]},{"items":[4,5,6]},{"items":[7]}]`, nil,
+		},
+		{"max pages", "/link", Pagination{Mode: PaginateLink, MaxPages: 3}, 0, allItems, nil},
+		{"too many pages", "/link", Pagination{Mode: PaginateLink, MaxPages: 2}, 0, "", &PaginationError{}},
+		{"max pages page", "/page", Pagination{Mode: PaginatePage, ItemsPath: "items", MaxPages: 3}, 0, allItems, nil},
+		{"too many pages page", "/page", Pagination{Mode: PaginatePage, ItemsPath: "items", MaxPages: 2}, 0, "", &PaginationError{}},
+		{"loop", "/loop", Pagination{Mode: PaginateLink}, 0, "", &PaginationError{}},
+		{"not json", "/html", Pagination{Mode: PaginateLink}, 0, "", &PaginationError{}},
+		{"no items", "/cursor", Pagination{Mode: PaginateCursor, NextPath: "meta.next", Param: "after", ItemsPath: "items"}, 0, "", &PaginationError{}},
+		{"max size", "/link", Pagination{Mode: PaginateLink}, 12, "", util.ErrMaxSizeExceeded},
+	}
+	for _, test := range tests {
+		if err := test.p.Validate(); err != nil {
+			t.Errorf("%s: invalid pagination: %v", test.name, err)
+			continue
+		}
+		res, err := NewHTTPFetcher(time.Second, "").FetchPages(context.Background(), srv.URL+test.path, &test.p, test.maxSize)
+		if test.wantErr != nil {
+			var paginationErr *PaginationError
+			if _, ok := test.wantErr.(*PaginationError); ok && !errors.As(err, &paginationErr) {
+				t.Errorf("%s: FetchPages returned %v, want a PaginationError", test.name, err)
+			} else if !ok && !errors.Is(err, test.wantErr) {
+				t.Errorf("%s: FetchPages returned %v, want %v", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: FetchPages failed: %v", test.name, err)
+			continue
+		}
+		if got := strings.TrimSpace(readResult(t, res)); got != test.want {
+			t.Errorf("%s: FetchPages returned %s, want %s", test.name, got, test.want)
+		}
+		if res.ETag != "" || res.LastModified != "" {
+			t.Errorf("%s: FetchPages returned validators %q, %q", test.name, res.ETag, res.LastModified)
+		}
+	}
+}
+
+func TestPaginationValidate(t *testing.T) {
+	for _, p := range []Pagination{
+		{Mode: "offset"},
+		{Mode: PaginateLink, Param: "page"},
+		{Mode: PaginateCursor},
+		{Mode: PaginatePage, NextPath: "next"},
+		{Mode: PaginateLink, Merge: "concat"},
+		{Mode: PaginateLink, ItemsPath: "data.*"},
+		{Mode: PaginateCursor, NextPath: "meta..next"},
+		{Mode: PaginateLink, MaxPages: -1},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("pagination %+v is valid, want error", p)
+		}
+	}
+}
+
+// vim: cc=120:
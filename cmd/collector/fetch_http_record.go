@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mrngm/apploos/util"
+)
+
+// RecordingExt is the extension of a recorded request/response pair.
+const RecordingExt = ".har.json"
+
+// redactedHeaders are the (canonical) headers whose values are never recorded, in addition to the Headers of a source.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// replayAtTime is the parsed -replayAt, see setupRecording.
+var replayAtTime time.Time
+
+// Recording is a single request/response pair, modelled after an entry of the HTTP Archive (HAR) format. Request
+// bodies aren't recorded, as they may hold credentials (e.g. a login form), only their size and checksum. Headers that
+// carry credentials are redacted.
+type Recording struct {
+	StartedDateTime time.Time         `json:"startedDateTime"`
+	Time            float64           `json:"time"`
+	Request         RecordingRequest  `json:"request"`
+	Response        RecordingResponse `json:"response"`
+}
+
+type RecordingRequest struct {
+	Method   string            `json:"method"`
+	URL      string            `json:"url"`
+	Headers  []RecordingHeader `json:"headers"`
+	BodySize int64             `json:"bodySize"`
+	// BodySHA256 is the checksum of the request body, which is part of what identifies a request when replaying.
+	BodySHA256 string `json:"_bodySHA256,omitempty"`
+}
+
+type RecordingResponse struct {
+	Status     int               `json:"status"`
+	StatusText string            `json:"statusText"`
+	Headers    []RecordingHeader `json:"headers"`
+	Content    RecordingContent  `json:"content"`
+}
+
+type RecordingHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type RecordingContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	// Text holds the body, base64 encoded.
+	Text     []byte `json:"text"`
+	Encoding string `json:"encoding"`
+}
+
+// setupRecording checks -record, -replay and -replayAt.
+func setupRecording() error {
+	if *recordDir != "" && *replayDir != "" {
+		return fmt.Errorf("please provide either -record or -replay")
+	}
+	if *replayAt != "" {
+		if *replayDir == "" {
+			return fmt.Errorf("-replayAt needs -replay")
+		}
+		var err error
+		if replayAtTime, err = time.ParseInLocation(time.DateOnly, *replayAt, time.Local); err == nil {
+			// A date replays the recordings up to the end of that day
+			replayAtTime = replayAtTime.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		} else if replayAtTime, err = time.Parse(time.RFC3339, *replayAt); err != nil {
+			return fmt.Errorf("-replayAt %q is neither a date nor an RFC 3339 time", *replayAt)
+		}
+	}
+	if *recordDir != "" {
+		if err := os.MkdirAll(*recordDir, 0755); err != nil {
+			return fmt.Errorf("cannot create record directory: %v", err)
+		}
+	}
+	if *replayDir != "" {
+		if _, err := os.Stat(*replayDir); err != nil {
+			return fmt.Errorf("cannot use replay directory: %v", err)
+		}
+	}
+	return nil
+}
+
+// wrapTransport returns next wrapped according to -record, or replaced according to -replay. The values of
+// secretHeaders, e.g. the Headers of a source, are redacted in recordings along with redactedHeaders.
+func wrapTransport(next http.RoundTripper, secretHeaders []string) http.RoundTripper {
+	if *replayDir != "" {
+		return &ReplayTransport{dir: *replayDir, at: replayAtTime}
+	}
+	if *recordDir != "" {
+		redact := slices.Clone(redactedHeaders)
+		for _, name := range secretHeaders {
+			redact = append(redact, http.CanonicalHeaderKey(name))
+		}
+		return &RecordingTransport{next: next, dir: *recordDir, redact: redact}
+	}
+	return next
+}
+
+// recordingKey identifies a request by its method, URL and body, such that a replay finds what was recorded for it.
+func recordingKey(method, url string, bodySHA256 string) string {
+	sum := sha256.Sum256([]byte(method + " " + url + " " + bodySHA256))
+	return hex.EncodeToString(sum[:16])
+}
+
+// readRequestBody returns the body of req, its size and checksum, and leaves req with an unread copy of the body.
+func readRequestBody(req *http.Request) ([]byte, string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, "", nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, "", fmt.Errorf("reading request body failed: %v", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	return body, hex.EncodeToString(sum[:]), nil
+}
+
+// recordHeaders returns header in a stable order, with the values of the (canonical) headers in redact redacted.
+func recordHeaders(header http.Header, redact []string) []RecordingHeader {
+	ret := make([]RecordingHeader, 0, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			if slices.Contains(redact, http.CanonicalHeaderKey(name)) {
+				value = "<redacted>"
+			}
+			ret = append(ret, RecordingHeader{Name: name, Value: value})
+		}
+	}
+	slices.SortStableFunc(ret, func(a, b RecordingHeader) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return ret
+}
+
+// redactHeader returns a copy of header with the values of redactedHeaders redacted, such that credentials (e.g. a
+// session cookie) don't end up in the metadata of a snapshot either.
+func redactHeader(header http.Header) http.Header {
+	if header == nil {
+		return nil
+	}
+	ret := header.Clone()
+	for _, name := range redactedHeaders {
+		for i := range ret[name] {
+			ret[name][i] = "<redacted>"
+		}
+	}
+	return ret
+}
+
+// RecordingTransport is an http.RoundTripper that passes requests on to next, and saves every request/response pair
+// as a Recording in dir, with the values of the (canonical) headers in redact redacted. The response body is read
+// completely before it's returned.
+type RecordingTransport struct {
+	next   http.RoundTripper
+	dir    string
+	redact []string
+}
+
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper mustn't modify the request, so work on a copy of it
+	req = req.Clone(req.Context())
+	reqBody, bodySHA256, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	rec := Recording{
+		StartedDateTime: start,
+		Time:            float64(time.Since(start).Microseconds()) / 1000,
+		Request: RecordingRequest{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			Headers:    recordHeaders(req.Header, t.redact),
+			BodySize:   int64(len(reqBody)),
+			BodySHA256: bodySHA256,
+		},
+		Response: RecordingResponse{
+			Status:     resp.StatusCode,
+			StatusText: resp.Status,
+			Headers:    recordHeaders(resp.Header, t.redact),
+			Content: RecordingContent{
+				Size:     int64(len(body)),
+				MimeType: resp.Header.Get("content-type"),
+				Text:     body,
+				Encoding: "base64",
+			},
+		},
+	}
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(rec); err != nil {
+		slog.Error("cannot marshal recording", "err", err, util.Req2slog(req))
+		return resp, nil
+	}
+	dir := filepath.Join(t.dir, recordingKey(req.Method, req.URL.String(), bodySHA256))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Error("cannot create recording directory", "err", err, "dir", dir)
+		return resp, nil
+	}
+	// Recording failures don't fail the fetch, the recording is merely incomplete
+	fn := start.UTC().Format("20060102T150405.000000000Z") + RecordingExt
+	if _, err := util.SaveToDisk(req.Context(), dir, fn, buf.Bytes(), true, false); err != nil {
+		slog.Error("failed saving recording", "err", err, "dir", dir, "fn", fn)
+	} else {
+		slog.Debug("recorded response", "fn", filepath.Join(dir, fn), util.Req2slog(req))
+	}
+	return resp, nil
+}
+
+// ReplayTransport is an http.RoundTripper that answers requests from the recordings in dir (see RecordingTransport),
+// without using the network. Of the recordings of a request, the most recent one that started at or before at is
+// used, or the most recent one if at is zero. Recorded 304 (Not Modified) responses only answer conditional requests,
+// such that replaying into empty storage starts from the contents rather than from a response without them.
+type ReplayTransport struct {
+	dir string
+	at  time.Time
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	_, bodySHA256, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(t.dir, recordingKey(req.Method, req.URL.String(), bodySHA256))
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("reading recordings failed: %v", err)
+	}
+	conditional := req.Header.Get("if-none-match") != "" || req.Header.Get("if-modified-since") != ""
+	// The names start with the time the request started, so the last suitable one is the most recent
+	var rec *Recording
+	for i := len(entries) - 1; i >= 0 && rec == nil; i-- {
+		if !strings.HasSuffix(entries[i].Name(), RecordingExt) {
+			continue
+		}
+		contents, err := os.ReadFile(filepath.Join(dir, entries[i].Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading recording failed: %v", err)
+		}
+		candidate := &Recording{}
+		if err := json.Unmarshal(contents, candidate); err != nil {
+			return nil, fmt.Errorf("decoding recording %s failed: %v", entries[i].Name(), err)
+		}
+		if !conditional && candidate.Response.Status == http.StatusNotModified {
+			continue
+		}
+		if t.at.IsZero() || !candidate.StartedDateTime.After(t.at) {
+			rec = candidate
+		}
+	}
+	if rec == nil {
+		return nil, fmt.Errorf("no recording of %s %s at %v in %s", req.Method, req.URL, t.at, t.dir)
+	}
+	slog.Debug("replaying response", "recorded", rec.StartedDateTime, util.Req2slog(req))
+
+	header := http.Header{}
+	for _, h := range rec.Response.Headers {
+		header.Add(h.Name, h.Value)
+	}
+	return &http.Response{
+		Status:        rec.Response.StatusText,
+		StatusCode:    rec.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(rec.Response.Content.Text)),
+		ContentLength: int64(len(rec.Response.Content.Text)),
+		Request:       req,
+	}, nil
+}
+
+// vim: cc=120:
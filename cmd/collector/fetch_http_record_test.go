@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingClient returns a client that records its requests in dir, see -record.
+func recordingClient(t *testing.T, dir string, secretHeaders ...string) *http.Client {
+	t.Helper()
+	*recordDir = dir
+	defer func() { *recordDir = "" }()
+	return &http.Client{Transport: wrapTransport(http.DefaultTransport.(*http.Transport).Clone(), secretHeaders)}
+}
+
+// replayingClient returns a client that replays the recordings in dir made at or before at, see -replay.
+func replayingClient(t *testing.T, dir string, at time.Time) *http.Client {
+	t.Helper()
+	*replayDir, replayAtTime = dir, at
+	defer func() { *replayDir, replayAtTime = "", time.Time{} }()
+	return &http.Client{Transport: wrapTransport(http.DefaultTransport, nil)}
+}
+
+// exchange sends a request and returns the status code and body of the response.
+func exchange(t *testing.T, client *http.Client, method, url, body string, header http.Header) (int, string, error) {
+	t.Helper()
+	var reqBody io.Reader
+	if body != "" {
+		reqBody = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		t.Fatalf("creating request failed: %v", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response failed: %v", err)
+	}
+	return resp.StatusCode, string(respBody), nil
+}
+
+func TestRecordReplay(t *testing.T) {
+	// Every response tells which version of the contents it holds
+	var version atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("set-cookie", "session=s3cret")
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, r.Method+" "+r.URL.Path+" "+string(body)+" v"+strings.Repeat("I", int(version.Load())))
+	}))
+	dir := t.TempDir()
+	client := recordingClient(t, dir)
+
+	auth := http.Header{"Authorization": {"Bearer s3cret"}, "X-Api-Key": {"s3cret"}}
+	version.Store(1)
+	exchange(t, client, http.MethodGet, srv.URL+"/feed", "", auth)
+	exchange(t, client, http.MethodPost, srv.URL+"/search", "q=a", nil)
+	exchange(t, client, http.MethodPost, srv.URL+"/search", "q=b", nil)
+	exchange(t, client, http.MethodGet, srv.URL+"/missing", "", nil)
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	version.Store(2)
+	exchange(t, client, http.MethodGet, srv.URL+"/feed", "", auth)
+	srv.Close()
+
+	// Credentials don't end up in the recordings
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(contents), "s3cret") {
+			t.Errorf("recording %s holds a credential", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("reading recordings failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		at     time.Time
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"latest", time.Time{}, http.MethodGet, "/feed", "", http.StatusOK, "GET /feed  vII"},
+		{"at", between, http.MethodGet, "/feed", "", http.StatusOK, "GET /feed  vI"},
+		{"after", time.Now(), http.MethodGet, "/feed", "", http.StatusOK, "GET /feed  vII"},
+		{"body a", time.Time{}, http.MethodPost, "/search", "q=a", http.StatusOK, "POST /search q=a vI"},
+		{"body b", time.Time{}, http.MethodPost, "/search", "q=b", http.StatusOK, "POST /search q=b vI"},
+		{"status", time.Time{}, http.MethodGet, "/missing", "", http.StatusNotFound, "404 page not found\n"},
+		{"other body", time.Time{}, http.MethodPost, "/search", "q=c", 0, ""},
+		{"other method", time.Time{}, http.MethodPost, "/feed", "", 0, ""},
+		{"before", between.Add(-time.Hour), http.MethodGet, "/feed", "", 0, ""},
+	}
+	for _, test := range tests {
+		status, body, err := exchange(t, replayingClient(t, dir, test.at), test.method, srv.URL+test.path, test.body, nil)
+		if test.status == 0 {
+			if err == nil {
+				t.Errorf("%s: replay returned %d %q, want error", test.name, status, body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: replay failed: %v", test.name, err)
+			continue
+		}
+		if status != test.status || body != test.want {
+			t.Errorf("%s: replay returned %d %q, want %d %q", test.name, status, body, test.status, test.want)
+		}
+	}
+}
+
+func TestReplayNotModified(t *testing.T) {
+	srv := serveContent(t, `{"a": 1}`, `"v1"`, time.Time{})
+	dir := t.TempDir()
+	client := recordingClient(t, dir)
+	conditional := http.Header{"If-None-Match": {`"v1"`}}
+	exchange(t, client, http.MethodGet, srv.URL, "", nil)
+	exchange(t, client, http.MethodGet, srv.URL, "", conditional)
+	srv.Close()
+
+	// The most recent recording is a 304, which only answers a conditional request
+	replay := replayingClient(t, dir, time.Time{})
+	if status, body, err := exchange(t, replay, http.MethodGet, srv.URL, "", nil); err != nil || status != http.StatusOK || body != `{"a": 1}` {
+		t.Errorf("unconditional replay returned %d %q, %v, want 200 with contents", status, body, err)
+	}
+	if status, _, err := exchange(t, replay, http.MethodGet, srv.URL, "", conditional); err != nil || status != http.StatusNotModified {
+		t.Errorf("conditional replay returned %d, %v, want 304", status, err)
+	}
+}
+
+func TestRecordRedactsSourceHeaders(t *testing.T) {
+	srv := serveContent(t, `{"a": 1}`, "", time.Time{})
+	dir := t.TempDir()
+	client := recordingClient(t, dir, "x-auth-token")
+	exchange(t, client, http.MethodGet, srv.URL, "", http.Header{"X-Auth-Token": {"s3cret"}, "X-Trace": {"visible"}})
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*", "*"+RecordingExt))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("found recordings %v, %v, want one", matches, err)
+	}
+	contents, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatalf("reading recording failed: %v", err)
+	}
+	if strings.Contains(string(contents), "s3cret") || !strings.Contains(string(contents), "visible") {
+		t.Errorf("recording doesn't redact just the header of the source:\n%s", contents)
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	header := http.Header{"Set-Cookie": {"a=s3cret", "b=s3cret"}, "Content-Type": {"application/json"}}
+	redacted := redactHeader(header)
+	want := http.Header{"Set-Cookie": {"<redacted>", "<redacted>"}, "Content-Type": {"application/json"}}
+	if !reflect.DeepEqual(redacted, want) {
+		t.Errorf("redactHeader returned %v, want %v", redacted, want)
+	}
+	if header.Get("Set-Cookie") != "a=s3cret" {
+		t.Errorf("redactHeader modified its argument: %v", header)
+	}
+}
+
+// vim: cc=120:
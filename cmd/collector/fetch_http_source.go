@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	p := &Protocol{
+		Usage:    "Request over HTTP, with GET unless Method or Body say otherwise",
+		Fields:   []string{"Transport", "Session", "Accept", "UserAgent", "BasicAuth", "BearerToken", "Headers", "Method", "Body", "Pagination"},
+		Validate: validateHTTPSource,
+		New: func(src *Source) (Fetcher, error) {
+			hf, err := NewSourceHTTPFetcher(src)
+			if err != nil {
+				return nil, err
+			}
+			return &httpSource{src: src, hf: hf}, nil
+		},
+	}
+	RegisterProtocol("http://", p)
+	RegisterProtocol("https://", p)
+}
+
+// httpSource is the Fetcher of an http:// or https:// source. Its HTTPFetcher is reused for every fetch, such that
+// connections and session cookies are kept.
+type httpSource struct {
+	src *Source
+	hf  *HTTPFetcher
+}
+
+func (s *httpSource) Fetch(ctx context.Context, prev SourceState) (*FetchResult, error) {
+	options := s.src.HTTPFetchOptions()
+	if s.src.Pagination != nil {
+		return s.hf.FetchPages(ctx, s.src.URL, s.src.Pagination, s.src.MaxSize, options...)
+	}
+	if prev.ETag != "" {
+		options = append(options, WithIfNoneMatch(prev.ETag))
+	}
+	if prev.LastModified != "" {
+		options = append(options, WithIfModifiedSince(prev.LastModified))
+	}
+	return s.hf.Fetch(ctx, s.src.URL, options...)
+}
+
+// Close closes the idle connections of the source.
+func (s *httpSource) Close() error {
+	s.hf.CloseIdleConnections()
+	return nil
+}
+
+// validateHTTPSource checks the request options of an http:// or https:// source, and defaults Method to POST if a Body
+// is given.
+func validateHTTPSource(s *Source) error {
+	if s.Transport != nil {
+		if err := s.Transport.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.Session != nil {
+		if err := s.Session.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.Accept != "" && !strings.Contains(s.Accept, "/") {
+		return fmt.Errorf("accept %q doesn't contain /", s.Accept)
+	}
+	if s.BearerToken != nil {
+		if (s.BearerToken.File == "") == (s.BearerToken.Env == "") {
+			return fmt.Errorf("bearer token needs either file or env")
+		}
+		if _, err := s.BearerToken.Read(); err != nil {
+			return fmt.Errorf("cannot read bearer token: %v", err)
+		}
+	}
+	for name, val := range s.Headers {
+		if !isToken(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(val, "\r\n") {
+			return fmt.Errorf("value of header %q contains a newline", name)
+		}
+	}
+	if s.Body != nil {
+		if err := s.Body.Validate(); err != nil {
+			return err
+		}
+		if s.Method == "" {
+			s.Method = http.MethodPost
+		}
+	}
+	if s.Method != "" {
+		if !isToken(s.Method) {
+			return fmt.Errorf("invalid method %q", s.Method)
+		}
+	}
+	if s.Pagination != nil {
+		if err := s.Pagination.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vim: cc=120:
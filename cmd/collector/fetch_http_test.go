@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveContent returns a test server that serves body with the given validators, and answers matching conditional
+// requests with 304 Not Modified. Validators that are empty or zero aren't sent.
+func serveContent(t *testing.T, body string, etag string, modTime time.Time) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if etag != "" {
+			w.Header().Set("etag", etag)
+		}
+		w.Header().Set("content-type", "application/json")
+		http.ServeContent(w, r, "", modTime, bytes.NewReader([]byte(body)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// readResult reads and closes the Body of res.
+func readResult(t *testing.T, res *FetchResult) string {
+	t.Helper()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading body failed: %v", err)
+	}
+	if err := res.Body.Close(); err != nil {
+		t.Fatalf("closing body failed: %v", err)
+	}
+	return string(body)
+}
+
+func TestHTTPFetcherConditional(t *testing.T) {
+	modTime := time.Date(2025, 7, 12, 10, 0, 0, 0, time.UTC)
+	lastModified := modTime.Format(http.TimeFormat)
+	tests := []struct {
+		name    string
+		etag    string
+		modTime time.Time
+		// options returns the options of the second request, given the result of the first one
+		options      func(first *FetchResult) []HTTPFetchOption
+		notModified  bool
+		wantETag     string
+		wantModified string
+	}{
+		{
+			"etag",
+			`"v1"`, time.Time{},
+			func(first *FetchResult) []HTTPFetchOption { return []HTTPFetchOption{WithIfNoneMatch(first.ETag)} },
+			true, `"v1"`, "",
+		},
+		{
+			"last-modified",
+			"", modTime,
+			func(first *FetchResult) []HTTPFetchOption {
+				return []HTTPFetchOption{WithIfModifiedSince(first.LastModified)}
+			},
+			true, "", lastModified,
+		},
+		{
+			"both",
+			`"v1"`, modTime,
+			func(first *FetchResult) []HTTPFetchOption {
+				return []HTTPFetchOption{WithIfNoneMatch(first.ETag), WithIfModifiedSince(first.LastModified)}
+			},
+			true, `"v1"`, lastModified,
+		},
+		{
+			"changed etag",
+			`"v1"`, time.Time{},
+			func(first *FetchResult) []HTTPFetchOption { return []HTTPFetchOption{WithIfNoneMatch(`"v0"`)} },
+			false, `"v1"`, "",
+		},
+		{
+			"changed since",
+			"", modTime,
+			func(first *FetchResult) []HTTPFetchOption {
+				return []HTTPFetchOption{WithIfModifiedSince(modTime.Add(-time.Hour).Format(http.TimeFormat))}
+			},
+			false, "", lastModified,
+		},
+		{
+			"unconditional",
+			`"v1"`, modTime,
+			func(first *FetchResult) []HTTPFetchOption { return nil },
+			false, `"v1"`, lastModified,
+		},
+	}
+	for _, test := range tests {
+		srv := serveContent(t, `{"a": 1}`, test.etag, test.modTime)
+		hf := NewHTTPFetcher(time.Second, "")
+
+		first, err := hf.Fetch(context.Background(), srv.URL)
+		if err != nil {
+			t.Errorf("%s: first fetch failed: %v", test.name, err)
+			continue
+		}
+		if body := readResult(t, first); body != `{"a": 1}` {
+			t.Errorf("%s: first fetch returned %q", test.name, body)
+		}
+		if first.ETag != test.wantETag || first.LastModified != test.wantModified {
+			t.Errorf("%s: validators %q, %q, want %q, %q", test.name, first.ETag, first.LastModified, test.wantETag, test.wantModified)
+		}
+
+		second, err := hf.Fetch(context.Background(), srv.URL, test.options(first)...)
+		if test.notModified {
+			if !errors.Is(err, ErrNotModified) {
+				t.Errorf("%s: second fetch returned %v, want ErrNotModified", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: second fetch failed: %v", test.name, err)
+			continue
+		}
+		readResult(t, second)
+	}
+}
+
+func TestHTTPFetcherIgnoresBadLastModified(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("last-modified", "yesterday")
+		io.WriteString(w, "contents")
+	}))
+	defer srv.Close()
+
+	res, err := NewHTTPFetcher(time.Second, "").Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	readResult(t, res)
+	if res.LastModified != "" {
+		t.Errorf("LastModified is %q, want it empty", res.LastModified)
+	}
+}
+
+func TestHTTPFetcherRejects(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		expect      string
+		// reason is the reason of the RejectedError, or empty if the response is accepted
+		reason string
+	}{
+		{"ok", http.StatusOK, "application/json", "{}", "", ""},
+		{"no content", http.StatusNoContent, "application/json", "", "", "empty"},
+		{"empty", http.StatusOK, "application/json", "", "", "empty"},
+		{"not found", http.StatusNotFound, "text/html", "<h1>Not Found</h1>", "", "status-404"},
+		{"server error", http.StatusInternalServerError, "text/plain", "oops", "", "status-500"},
+		{"redirect", http.StatusMultipleChoices, "text/plain", "choose", "", "status-300"},
+		{"expected type", http.StatusOK, "application/json; charset=utf-8", "{}", "application/json", ""},
+		{"one of types", http.StatusOK, "text/calendar", "BEGIN:VCALENDAR", "application/json, text/calendar", ""},
+		{"wildcard type", http.StatusOK, "text/calendar", "BEGIN:VCALENDAR", "text/*", ""},
+		{"case of type", http.StatusOK, "Application/JSON", "{}", "application/json", ""},
+		{"unexpected type", http.StatusOK, "text/html", "<h1>Maintenance</h1>", "application/json", "content-type"},
+		{"no type", http.StatusOK, "", "{}", "application/json", "content-type"},
+	}
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header()["Content-Type"] = []string{test.contentType}
+			w.WriteHeader(test.status)
+			io.WriteString(w, test.body)
+		}))
+		t.Cleanup(srv.Close)
+		res, err := NewHTTPFetcher(time.Second, test.expect).Fetch(context.Background(), srv.URL)
+
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%s: fetch failed: %v", test.name, err)
+			} else if body := readResult(t, res); body != test.body {
+				t.Errorf("%s: fetch returned %q, want %q", test.name, body, test.body)
+			}
+			continue
+		}
+		var rejected RejectedError
+		if !errors.As(err, &rejected) {
+			t.Errorf("%s: fetch returned %v, want a RejectedError", test.name, err)
+			continue
+		}
+		reason, body := rejected.Rejected()
+		if reason != test.reason || string(body) != test.body {
+			t.Errorf("%s: rejected with %q, %q, want %q, %q", test.name, reason, body, test.reason, test.body)
+		}
+		var statusErr *HTTPStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode != test.status {
+			t.Errorf("%s: status code %d, want %d", test.name, statusErr.StatusCode, test.status)
+		}
+	}
+}
+
+func TestHTTPFetcherBrokenBody(t *testing.T) {
+	// The connection is closed before any of the promised body is sent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-length", "100")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	_, err := NewHTTPFetcher(time.Second, "").Fetch(context.Background(), srv.URL)
+	var rejected RejectedError
+	if err == nil || errors.As(err, &rejected) || !IsTransient(err) {
+		t.Errorf("fetch returned %v, want a transient error", err)
+	}
+}
+
+func TestHTTPFetcherTimings(t *testing.T) {
+	srv := serveContent(t, `{"a": 1}`, "", time.Time{})
+	res, err := NewHTTPFetcher(time.Second, "").Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if res.Timings == nil {
+		t.Fatalf("fetch returned no Timings")
+	}
+	readResult(t, res)
+	if timings := *res.Timings; timings.TTFB <= 0 || timings.Total < timings.TTFB {
+		t.Errorf("Timings are %+v, want a TTFB within the total", timings)
+	}
+}
+
+// vim: cc=120:
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mrngm/apploos/util"
+)
+
+// httpTimer records the util.HTTPTimings of a single request through an httptrace.ClientTrace. The trace callbacks
+// may be called from several goroutines, e.g. when dialing multiple addresses at once, and even after the request
+// finished. Hence the timings are only handed out as a copy, see result.
+type httpTimer struct {
+	mu                               sync.Mutex
+	start                            time.Time
+	dnsStart, connectStart, tlsStart time.Time
+	timings                          util.HTTPTimings
+	finished                         bool
+	// result receives a copy of timings when the request finishes
+	result *util.HTTPTimings
+}
+
+func newHTTPTimer() *httpTimer {
+	return &httpTimer{start: time.Now(), result: &util.HTTPTimings{}}
+}
+
+// begin marks the start of a phase in at.
+func (t *httpTimer) begin(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	*at = time.Now()
+}
+
+// end adds the time since the start of a phase in at to d.
+func (t *httpTimer) end(at *time.Time, d *time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !at.IsZero() {
+		*d += time.Since(*at)
+		*at = time.Time{}
+	}
+}
+
+func (t *httpTimer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.begin(&t.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.end(&t.dnsStart, &t.timings.DNS) },
+		ConnectStart: func(string, string) {
+			t.begin(&t.connectStart)
+		},
+		ConnectDone: func(string, string, error) {
+			t.end(&t.connectStart, &t.timings.Connect)
+		},
+		TLSHandshakeStart: func() { t.begin(&t.tlsStart) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.end(&t.tlsStart, &t.timings.TLSHandshake)
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.TTFB = time.Since(t.start)
+		},
+	}
+}
+
+// finish sets the total duration of req, once, copies the timings to result and logs them.
+func (t *httpTimer) finish(reqId uuid.UUID, req *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	t.finished = true
+	t.timings.Total = time.Since(t.start)
+	*t.result = t.timings
+	slog.Info("request timings", "request-id", reqId, util.Req2slog(req), "timings", t.timings)
+}
+
+// timedBody calls done once the body was read completely or closed, whichever comes first.
+type timedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
+// vim: cc=120:
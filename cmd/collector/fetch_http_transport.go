@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mrngm/apploos/util"
+)
+
+// tlsVersions maps the accepted values of HTTPTransport.MinTLSVersion to their crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// HTTPTransport configures how an http:// or https:// source is reached. The zero value behaves like
+// http.DefaultTransport.
+type HTTPTransport struct {
+	// Proxy is the URL of the proxy to use, e.g. http://proxy.example.org:3128. Defaults to the proxy from the
+	// environment, see http.ProxyFromEnvironment.
+	Proxy string `json:",omitempty"`
+	// CAFile is a PEM bundle of certificate authorities that is trusted instead of the system roots.
+	CAFile string `json:",omitempty"`
+	// ClientCert and ClientKey are PEM files of a client certificate and its key, for sources that require
+	// authentication through TLS.
+	ClientCert string `json:",omitempty"`
+	ClientKey  string `json:",omitempty"`
+	// MinTLSVersion is the minimum TLS version: "1.0", "1.1", "1.2" or "1.3". Defaults to that of crypto/tls.
+	MinTLSVersion string `json:",omitempty"`
+}
+
+// HTTPSession keeps cookies in between requests to a source, for sources that need a login session. If LoginURL is
+// given, LoginForm is POSTed to it (as application/x-www-form-urlencoded) before the first fetch, and again whenever
+// the source responds with 401 Unauthorized or 403 Forbidden.
+type HTTPSession struct {
+	LoginURL  string            `json:",omitempty"`
+	LoginForm map[string]string `json:",omitempty"`
+}
+
+// Validate checks the HTTPTransport for consistency, including whether the files it refers to can be loaded.
+func (t *HTTPTransport) Validate() error {
+	_, err := t.tlsConfig()
+	if err != nil {
+		return err
+	}
+	if t.Proxy != "" {
+		if _, err := url.Parse(t.Proxy); err != nil {
+			return fmt.Errorf("invalid proxy %q: %v", t.Proxy, err)
+		}
+	}
+	return nil
+}
+
+func (t *HTTPTransport) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if t.MinTLSVersion != "" {
+		version, ok := tlsVersions[t.MinTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported minimum TLS version %q", t.MinTLSVersion)
+		}
+		cfg.MinVersion = version
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", t.CAFile)
+		}
+	}
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return nil, fmt.Errorf("client certificate and key should be given together")
+	}
+	if t.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// newTransport returns a copy of http.DefaultTransport configured according to t.
+func (t *HTTPTransport) newTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := t.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	if t.Proxy != "" {
+		proxy, err := url.Parse(t.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", t.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return transport, nil
+}
+
+// Validate checks the HTTPSession for consistency.
+func (s *HTTPSession) Validate() error {
+	if s.LoginURL == "" {
+		if len(s.LoginForm) > 0 {
+			return fmt.Errorf("login form without login URL")
+		}
+		return nil
+	}
+	u, err := url.Parse(s.LoginURL)
+	if err != nil {
+		return fmt.Errorf("invalid login URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("login URL %q must be an http:// or https:// URL", s.LoginURL)
+	}
+	return nil
+}
+
+// NewSourceHTTPFetcher returns an HTTPFetcher for src, which must be validated already. It's meant to be built once and
+// reused for every fetch of src, such that connections and session cookies are kept. Its requests are recorded or
+// replayed according to -record and -replay.
+func NewSourceHTTPFetcher(src *Source) (*HTTPFetcher, error) {
+	hf := NewHTTPFetcher(time.Duration(src.Timeout), src.ExpectContentType)
+	// Every source has its own connection pool, such that closing the idle connections of one source doesn't affect
+	// the others
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if src.Transport != nil {
+		var err error
+		if transport, err = src.Transport.newTransport(); err != nil {
+			return nil, err
+		}
+	}
+	// Headers of a source typically carry API keys, so they're kept out of recordings
+	secretHeaders := make([]string, 0, len(src.Headers))
+	for name := range src.Headers {
+		secretHeaders = append(secretHeaders, name)
+	}
+	hf.client.Transport = wrapTransport(transport, secretHeaders)
+	if src.Session != nil {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		hf.client.Jar = jar
+		hf.session = src.Session
+	}
+	return hf, nil
+}
+
+// login POSTs the login form of the session, such that the cookie jar holds a session afterwards.
+func (hf *HTTPFetcher) login(ctx context.Context) error {
+	form := url.Values{}
+	for k, v := range hf.session.LoginForm {
+		form.Set(k, v)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hf.session.LoginURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("creating login request failed: %v", err)
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.Header.Set("user-agent", *appname)
+
+	resp, err := hf.client.Do(req)
+	if err != nil {
+		slog.Error("login request failed", "err", err, util.Req2slog(req))
+		return fmt.Errorf("login failed: %w", err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, MaxRejectedBodySize))
+	if err := resp.Body.Close(); err != nil {
+		slog.Error("closing login response body failed", "err", err, util.Req2slog(req))
+	}
+	if resp.StatusCode >= 400 {
+		slog.Error("login refused", util.Resp2slog(resp))
+		return fmt.Errorf("login failed with status %q", resp.Status)
+	}
+	slog.Info("logged in", "url", hf.session.LoginURL, "status", resp.Status)
+	return nil
+}
+
+// vim: cc=120:
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// MaxHookOutputSize is the number of bytes of the output of a hook (combined stdout and stderr for Exec, the response
+// body for Webhook) that is logged when it fails.
+const MaxHookOutputSize = 4 << 10
+
+// Hook is notified when a source changes, i.e. when a snapshot with another checksum than the previous one is stored.
+// As an alert hook of a SanityPolicy, it's notified when a snapshot is quarantined instead. Exactly one of Exec and
+// Webhook is given.
+type Hook struct {
+	// Exec is a command and its arguments, which is run without a shell. The ChangeEvent is passed in the environment,
+	// see ChangeEvent.Environ.
+	Exec []string `json:",omitempty"`
+	// Webhook is an http:// or https:// URL to which the ChangeEvent is POSTed as JSON. Any 2xx response is a success.
+	Webhook string `json:",omitempty"`
+	// Timeout limits a single attempt. Defaults to -hookTimeout.
+	Timeout Duration
+	// Retry determines how often, and how fast, a failing hook is retried. Every failure is retried, as it's up to the
+	// hook to decide what's transient. Defaults like Source.Retry.
+	Retry RetryPolicy
+}
+
+// Types of ChangeEvent.
+const (
+	EventChange = "change"
+	EventSanity = "sanity"
+)
+
+// ChangeEvent describes a change of a source, as passed to its hooks.
+type ChangeEvent struct {
+	// Event is EventChange, or EventSanity for a snapshot that failed the SanityPolicy of the source, in which case
+	// NewChecksum is empty, BlobPath is the quarantined snapshot and Reason says why it failed.
+	Event  string
+	Reason string `json:",omitempty"`
+	Source string
+	URL    string
+	// OldChecksum is the checksum of the previous snapshot, and empty for the first snapshot of a source.
+	OldChecksum string
+	NewChecksum string
+	// BlobPath is the path of the stored snapshot.
+	BlobPath  string
+	RequestId string `json:",omitempty"`
+	FetchEnd  time.Time
+}
+
+// Environ returns the environment variables that describe the event, for Exec hooks: APPLOOS_EVENT, APPLOOS_REASON,
+// APPLOOS_SOURCE, APPLOOS_URL, APPLOOS_OLD_CHECKSUM, APPLOOS_NEW_CHECKSUM, APPLOOS_BLOB_PATH, APPLOOS_REQUEST_ID and
+// APPLOOS_FETCH_END (RFC 3339).
+func (ev ChangeEvent) Environ() []string {
+	return []string{
+		"APPLOOS_EVENT=" + ev.Event,
+		"APPLOOS_REASON=" + ev.Reason,
+		"APPLOOS_SOURCE=" + ev.Source,
+		"APPLOOS_URL=" + ev.URL,
+		"APPLOOS_OLD_CHECKSUM=" + ev.OldChecksum,
+		"APPLOOS_NEW_CHECKSUM=" + ev.NewChecksum,
+		"APPLOOS_BLOB_PATH=" + ev.BlobPath,
+		"APPLOOS_REQUEST_ID=" + ev.RequestId,
+		"APPLOOS_FETCH_END=" + ev.FetchEnd.Format(time.RFC3339Nano),
+	}
+}
+
+// Validate checks the Hook for consistency and fills in defaults from the command line flags.
+func (h *Hook) Validate() error {
+	if (len(h.Exec) == 0) == (h.Webhook == "") {
+		return fmt.Errorf("hook needs either exec or webhook")
+	}
+	if len(h.Exec) > 0 && h.Exec[0] == "" {
+		return fmt.Errorf("hook has an empty command")
+	}
+	if h.Webhook != "" {
+		u, err := url.Parse(h.Webhook)
+		if err != nil {
+			return fmt.Errorf("invalid webhook: %v", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %q must be an http:// or https:// URL", h.Webhook)
+		}
+	}
+	if h.Timeout == 0 {
+		h.Timeout = Duration(*hookTimeout)
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("negative hook timeout %v", time.Duration(h.Timeout))
+	}
+	if h.Retry.Attempts == 0 {
+		h.Retry.Attempts = *retries
+	}
+	if h.Retry.Backoff.Base == 0 {
+		h.Retry.Backoff.Base = Duration(*retryBase)
+	}
+	if h.Retry.Backoff.Max == 0 {
+		h.Retry.Backoff.Max = Duration(*retryMax)
+	}
+	if h.Retry.Backoff.Base < 0 || h.Retry.Backoff.Max < h.Retry.Backoff.Base {
+		return fmt.Errorf("invalid hook retry policy %+v", h.Retry)
+	}
+	return nil
+}
+
+// String identifies the hook in logs.
+func (h *Hook) String() string {
+	if h.Webhook != "" {
+		return "webhook " + h.Webhook
+	}
+	return "exec " + h.Exec[0]
+}
+
+// Run notifies the hook of ev, retrying failures according to its RetryPolicy, until it succeeds or ctx is done.
+func (h *Hook) Run(ctx context.Context, ev ChangeEvent) error {
+	for attempt := 0; ; attempt++ {
+		err := h.runOnce(ctx, ev)
+		if err == nil {
+			slog.Info("hook succeeded", "hook", h.String(), "src", ev.Source, "checksum", ev.NewChecksum, "attempt", attempt)
+			return nil
+		}
+		if attempt >= h.Retry.Attempts || ctx.Err() != nil {
+			slog.Error("hook failed", "err", err, "hook", h.String(), "src", ev.Source, "checksum", ev.NewChecksum, "retries", attempt)
+			return err
+		}
+		backoff := h.Retry.Backoff.Duration(attempt)
+		slog.Warn("hook failed, retrying", "err", err, "hook", h.String(), "src", ev.Source, "attempt", attempt+1, "maxAttempts", h.Retry.Attempts, "backoff", backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (h *Hook) runOnce(ctx context.Context, ev ChangeEvent) error {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(h.Timeout))
+		defer cancel()
+	}
+	if h.Webhook != "" {
+		return h.post(ctx, ev)
+	}
+	return h.exec(ctx, ev)
+}
+
+func (h *Hook) exec(ctx context.Context, ev ChangeEvent) error {
+	cmd := exec.CommandContext(ctx, h.Exec[0], h.Exec[1:]...)
+	cmd.Env = append(os.Environ(), ev.Environ()...)
+	// Don't wait forever for children of the command that keep its output open
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(output) > MaxHookOutputSize {
+			output = output[:MaxHookOutputSize]
+		}
+		return fmt.Errorf("running %q failed: %v, output: %q", h.Exec, err, output)
+	}
+	return nil
+}
+
+func (h *Hook) post(ctx context.Context, ev ChangeEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.Webhook, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("creating request failed: %v", err)
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("user-agent", *appname)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, MaxHookOutputSize))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q from %s, body: %q", resp.Status, h.Webhook, body)
+	}
+	return nil
+}
+
+// vim: cc=120:
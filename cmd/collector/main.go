@@ -8,41 +8,130 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/fs"
 	"log/slog"
-	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/mrngm/apploos/util"
 )
 
 var (
-	once            = flag.Bool("once", false, "If given, fetch source once, write to storage, and exit. Otherwise, keep running and fetch every interval.")
-	refreshInterval = flag.Duration("interval", time.Duration(5*time.Minute), "Refresh source every duration with jitter. Ignored when -once is given")
-	refreshJitter   = flag.Duration("jitter", time.Duration(23*time.Second), "Apply jitter up to (-)duration on refresh interval, e.g. 5m (interval) +/- 23s (jitter). Jitter's granularity is seconds")
-	source          = flag.String("source", "", fmt.Sprintf("Fetch this source, prefixed with protocol://. Supported: %+q", SupportedProtocols))
-	saveDir         = flag.String("storage", "", "Store results in this directory. If not supplied, a temporary directory will be created. If the supplied directory doesn't exist, it's created given enough permissions. Existing files in the supplied directory are never overwritten.")
-	appname         = flag.String("appname", "", "Set the application name (used in e.g. user-agent and request-id)")
-	cleanupTmp      = flag.Bool("cleanTmp", false, "Cleanup temporary files after either a successful or unsuccessful write")
-	cleanupTmpDir   = flag.Bool("cleanTmpDir", false, "Cleanup temporary directory if -saveDir wasn't supplied")
+	once               = flag.Bool("once", false, "If given, fetch every source once, write to storage, and exit. Otherwise, keep running and fetch every interval.")
+	refreshInterval    = flag.Duration("interval", time.Duration(5*time.Minute), "Refresh source every duration with jitter. Ignored when -once is given")
+	refreshJitter      = flag.Duration("jitter", time.Duration(23*time.Second), "Apply jitter up to (-)duration on refresh interval, e.g. 5m (interval) +/- 23s (jitter). Jitter's granularity is seconds")
+	source             = flag.String("source", "", "Fetch this source, prefixed with protocol:// (see the supported protocols below). Use -config for multiple sources")
+	configFile         = flag.String("config", "", "Read the sources to fetch from this JSON file, see Config. Sources take their defaults from the other flags")
+	workers            = flag.Int("workers", 4, "Fetch at most this many sources concurrently")
+	saveDir            = flag.String("storage", "", "Store results in this directory. If not supplied, a temporary directory will be created. If the supplied directory doesn't exist, it's created given enough permissions. Existing files in the supplied directory are never overwritten.")
+	appname            = flag.String("appname", "", "Set the application name (used in e.g. user-agent and request-id)")
+	cleanupTmp         = flag.Bool("cleanTmp", false, "Cleanup temporary files after either a successful or unsuccessful write")
+	cleanupTmpDir      = flag.Bool("cleanTmpDir", false, "Cleanup temporary directory if -saveDir wasn't supplied")
+	followSymlinks     = flag.Bool("followSymlinks", false, "Follow symbolic links for file:// sources. Otherwise, a source that is a symbolic link is refused")
+	expectType         = flag.String("expectContentType", "", "Comma separated list of media types (e.g. application/json) sources must respond with. Other responses are quarantined. Ignored when empty")
+	maxSize            = flag.Int64("maxSize", 64<<20, "Discard fetched contents larger than this many bytes. Unlimited when <= 0")
+	fetchTimeout       = flag.Duration("timeout", 4*time.Minute, "Give up on fetching a source after this duration")
+	retries            = flag.Int("retries", 3, "Retry a transient failure (e.g. timeout, 5xx, connection reset) this many times before waiting for the next interval")
+	retryBase          = flag.Duration("retryBase", 2*time.Second, "Wait up to this duration before the first retry, doubling for every next retry")
+	retryMax           = flag.Duration("retryMax", time.Minute, "Wait at most this duration before a retry")
+	breakerThreshold   = flag.Int("breakerThreshold", 5, "After this many consecutive failed fetches, slow down polling the source by doubling its interval for every further failure. Disabled when <= 0")
+	breakerMaxInterval = flag.Duration("breakerMaxInterval", 6*time.Hour, "Poll a failing source at least this often")
+	shutdownGrace      = flag.Duration("shutdownGrace", 30*time.Second, "Upon SIGINT or SIGTERM, give in-flight fetches this long to finish before cancelling them")
+	watchInterval      = flag.Duration("watch", 0, "Poll the file:// -source every duration and fetch as soon as it changes, in addition to the refresh interval. Disabled when 0 or when -once is given")
+	hookTimeout        = flag.Duration("hookTimeout", 30*time.Second, "Give a single attempt of a change hook this long, see Hook")
+	listen             = flag.String("listen", "", "Serve /healthz, /readyz and Prometheus /metrics on this address, e.g. localhost:9100. Disabled when empty")
+	keepLast           = flag.Int("keepLast", 0, "After storing a new snapshot, keep this many most recent snapshots of the source and prune the others, see RetentionPolicy. Everything is kept when -keepLast, -keepHourly and -keepDaily are all <= 0")
+	keepHourly         = flag.Int("keepHourly", 0, "Beyond -keepLast, keep the most recent snapshot of this many hours")
+	keepDaily          = flag.Int("keepDaily", 0, "Beyond -keepLast, keep the most recent snapshot of this many days")
+	recordDir          = flag.String("record", "", "Save every HTTP request/response pair in this directory (HAR-like JSON, credentials redacted), such that it can be replayed with -replay")
+	replayDir          = flag.String("replay", "", "Answer HTTP requests from the recordings in this directory (see -record) instead of the network")
+	replayAt           = flag.String("replayAt", "", "With -replay, use the most recent recordings made at or before this date (2006-01-02, up to the end of that day) or RFC 3339 time, instead of the most recent ones")
+	lockWait           = flag.Duration("lockWait", 0, "If another collector holds the lock on -storage, wait this long for it to exit instead of failing right away. Waits indefinitely when < 0")
 )
 
 var (
 	logLevel = new(slog.LevelVar)
 )
 
+func setupLogger() *slog.Logger {
+	logLevel.Set(slog.LevelDebug)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	slog.SetDefault(logger)
+	return logger
+}
+
+// usage prints the flags, the registered protocols and the subcommands, see flag.Usage.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nSupported protocols:\n")
+	for _, prefix := range Protocols() {
+		p := protocols[prefix]
+		fmt.Fprintf(out, "  %-10s %s", prefix, p.Usage)
+		if len(p.Fields) > 0 {
+			fmt.Fprintf(out, " (source fields: %s)", strings.Join(p.Fields, ", "))
+		}
+		fmt.Fprintln(out)
+	}
+	fmt.Fprintf(out, "\nRun %s prune [-dryRun] with the same flags to apply the retention policy once.\n", os.Args[0])
+	fmt.Fprintf(out, "Run %s export -archive fn with the same flags to copy all snapshots into a tar archive.\n", os.Args[0])
+}
+
+// subcommandFlags returns a FlagSet for the subcommand name, which accepts all flags of the collector, such that
+// sources take the same defaults as they do in the collector.
+func subcommandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags.Var(f.Value, f.Name, f.Usage)
+	})
+	return flags
+}
+
+// loadConfig returns the validated Config from -config, or a Config with the single -source.
+func loadConfig() (*Config, error) {
+	var cfg *Config
+	if *configFile != "" {
+		if *source != "" {
+			return nil, fmt.Errorf("please provide either -config or -source")
+		}
+		var err error
+		cfg, err = LoadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cfg = &Config{
+			Sources: []*Source{{
+				URL:   *source,
+				Watch: Duration(*watchInterval),
+			}},
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "prune":
+			os.Exit(prune(os.Args[2:]))
+		case "export":
+			os.Exit(export(os.Args[2:]))
+		}
+	}
+	flag.Usage = usage
 	flag.Parse()
 	if flag.NArg() == 0 && flag.NFlag() == 0 {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		flag.PrintDefaults()
+		flag.Usage()
 		return
 	}
-	logLevel.Set(slog.LevelDebug)
-	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
-	slog.SetDefault(logger)
+	logger := setupLogger()
 
 	if *appname == "" {
 		*appname = "FIXME-to-be-nice"
@@ -98,57 +187,94 @@ func main() {
 		os.Exit(1)
 	}
 
-	shutdownCh := make(chan struct{})
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	go HandleSignals(ctx, shutdownCh)
-
-	nextTimeTicker := time.NewTicker(1 * time.Second)
-	defer nextTimeTicker.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			break
-		case <-shutdownCh:
-			cancel()
-			break
-		case <-nextTimeTicker.C:
-		}
-		srcReader, err := FetchSource(ctx, *source)
-		if err != nil {
-			logger.Error("FetchSource failed", "err", err)
-			return
+	// A single collector writes into -storage at a time, the lock is released when the process exits
+	lockCtx, cancelLock := context.WithCancel(context.Background())
+	if *lockWait > 0 {
+		lockCtx, cancelLock = context.WithTimeout(context.Background(), *lockWait)
+	}
+	lock, err := util.AcquireLock(lockCtx, filepath.Join(*saveDir, util.InstanceLockName), true, *lockWait != 0)
+	cancelLock()
+	if err != nil {
+		logger.Error("cannot lock storage directory, is another collector running?", "err", err, "dir", *saveDir)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			logger.Error("(deferred) releasing storage lock failed", "err", err, "dir", *saveDir)
 		}
+	}()
 
-		checksumWriter := NewChecksumWriter()
+	state, err := LoadStateStore(*saveDir)
+	if err != nil {
+		logger.Error("cannot load collector state", "err", err, "dir", *saveDir)
+		os.Exit(1)
+	}
 
-		srcContents, err := io.ReadAll(io.TeeReader(srcReader, checksumWriter))
-		if err != nil {
-			logger.Error("io.ReadAll on FetchSource failed", "err", err)
-			return
-		}
-		logger.Debug("FetchSource contents", "length", len(srcContents))
-		checksum := fmt.Sprintf("%x", checksumWriter.Sum256())
-		logger.Info("sha256(source)", "sum", checksum)
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	if err := setupRecording(); err != nil {
+		logger.Error("cannot record or replay", "err", err)
+		os.Exit(1)
+	}
+	if *replayDir != "" {
+		logger.Info("replaying HTTP responses instead of using the network", "dir", *replayDir, "at", replayAtTime)
+	}
 
-		written, err := util.SaveToDisk(ctx, *saveDir, checksum+".blob", srcContents, *cleanupTmp, false)
-		if err != nil {
-			logger.Error("failed saving to disk", "err", err)
-		}
-		logger.Debug("SaveToDisk returns", "written", written, "err", err)
+	collector, err := NewCollector(cfg, *saveDir, state, *shutdownGrace)
+	if err != nil {
+		logger.Error("cannot create collector", "err", err)
+		os.Exit(1)
+	}
 
-		if *once {
-			break
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Signals are handled until main returns, such that a second shutdown signal still exits right away
+	signalsCtx, stopSignals := context.WithCancel(context.Background())
+	defer stopSignals()
+	handlers := SignalHandlers{
+		Shutdown: func() {
+			logger.Info("shutting down", "grace", *shutdownGrace)
+			cancel()
+		},
+		FetchNow: collector.TriggerAll,
+	}
+	// With -once the sources are fetched right away and nothing picks up a new configuration
+	if !*once {
+		handlers.Reload = func() {
+			if *configFile == "" {
+				logger.Warn("no -config given, nothing to reload")
+				return
+			}
+			newCfg, err := LoadConfig(*configFile)
+			if err != nil {
+				logger.Error("reloading configuration failed, keeping the current one", "err", err)
+				return
+			}
+			if err := newCfg.Validate(); err != nil {
+				logger.Error("reloaded configuration is invalid, keeping the current one", "err", err)
+				return
+			}
+			if err := collector.Reload(newCfg); err != nil {
+				logger.Error("reloading configuration failed", "err", err)
+			}
 		}
+	}
+	go HandleSignals(signalsCtx, handlers)
 
-		// Calculate the next tick using *refreshInterval and *refreshJitter
-		jitterSeconds := time.Duration(-int((*refreshJitter).Seconds())+int(rand.Intn(2*int((*refreshJitter).Seconds())))) * time.Second
-		newInterval := *refreshInterval + jitterSeconds
-		logger.Debug("refresh + jitter", "refreshInterval", *refreshInterval, "proposedJitter", jitterSeconds, "newInterval", newInterval)
-		nextTimeTicker.Reset(newInterval)
+	if *listen != "" {
+		// The listener outlives ctx, such that /readyz reports the shutdown
+		go func() {
+			if err := Serve(signalsCtx, *listen, collector); err != nil {
+				logger.Error("serving health and metrics failed", "err", err)
+			}
+		}()
 	}
+
+	collector.Run(ctx, *once)
 }
 
 // vim: cc=120:
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrngm/apploos/util"
+)
+
+// Outcomes of a single fetch of a source, as counted by Metrics.
+const (
+	OutcomeChanged     = "changed"
+	OutcomeUnchanged   = "unchanged"
+	OutcomeNotModified = "not_modified"
+	OutcomeRejected    = "rejected"
+	OutcomeError       = "error"
+)
+
+// fetchDurationBuckets are the upper bounds of the fetch latency histogram, in seconds.
+var fetchDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 240}
+
+// httpPhaseBuckets are the upper bounds of the histograms of the phases of HTTP requests, in seconds.
+var httpPhaseBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// httpPhases are the phases of HTTP requests, see util.HTTPTimings.
+var httpPhases = []string{"dns", "connect", "tls", "ttfb", "total"}
+
+// Metrics keeps track of what the collector does per source, and writes it in the Prometheus text exposition format.
+// It's safe for use by multiple goroutines.
+type Metrics struct {
+	mu      sync.Mutex
+	sources map[string]*sourceMetrics
+}
+
+type sourceMetrics struct {
+	fetches     map[string]uint64
+	duration    *histogram
+	bytes       uint64
+	lastSuccess time.Time
+	// httpPhases maps the phases of HTTP requests (see httpPhases) to their durations
+	httpPhases map[string]*histogram
+
+	// The backoff state, as of the most recent fetch
+	retryAttempt        int
+	consecutiveFailures int
+	breakerOpen         bool
+	nextInterval        time.Duration
+}
+
+type histogram struct {
+	// buckets are the upper bounds of the buckets
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		sources: make(map[string]*sourceMetrics),
+	}
+}
+
+// source returns the metrics of name. The caller must hold m.mu.
+func (m *Metrics) source(name string) *sourceMetrics {
+	sm, ok := m.sources[name]
+	if !ok {
+		sm = &sourceMetrics{
+			fetches:    make(map[string]uint64),
+			duration:   newHistogram(fetchDurationBuckets),
+			httpPhases: make(map[string]*histogram),
+		}
+		for _, phase := range httpPhases {
+			sm.httpPhases[phase] = newHistogram(httpPhaseBuckets)
+		}
+		m.sources[name] = sm
+	}
+	return sm
+}
+
+// Fetched records a fetch of source with the given outcome, which took duration and resulted in size bytes.
+func (m *Metrics) Fetched(source string, outcome string, duration time.Duration, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm := m.source(source)
+	sm.fetches[outcome]++
+	sm.duration.observe(duration.Seconds())
+	if size > 0 {
+		sm.bytes += uint64(size)
+	}
+	switch outcome {
+	case OutcomeChanged, OutcomeUnchanged, OutcomeNotModified:
+		sm.lastSuccess = time.Now()
+	}
+}
+
+// HTTPTimings records the phases of an HTTP request of source.
+func (m *Metrics) HTTPTimings(source string, timings util.HTTPTimings) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm := m.source(source)
+	for phase, d := range map[string]time.Duration{
+		"dns":     timings.DNS,
+		"connect": timings.Connect,
+		"tls":     timings.TLSHandshake,
+		"ttfb":    timings.TTFB,
+		"total":   timings.Total,
+	} {
+		sm.httpPhases[phase].observe(d.Seconds())
+	}
+}
+
+// Backoff records the backoff state of source: the current retry attempt (0 if not retrying), the number of
+// consecutive failed fetches, whether its breaker is open, and the time until the next fetch.
+func (m *Metrics) Backoff(source string, retryAttempt int, consecutiveFailures int, breakerOpen bool, nextInterval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm := m.source(source)
+	sm.retryAttempt = retryAttempt
+	sm.consecutiveFailures = consecutiveFailures
+	sm.breakerOpen = breakerOpen
+	sm.nextInterval = nextInterval
+}
+
+// Forget drops the metrics of source, e.g. after it was removed from the configuration.
+func (m *Metrics) Forget(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sources, source)
+}
+
+// LastSuccess returns the moment of the most recent successful fetch of source, or the zero time.
+func (m *Metrics) LastSuccess(source string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sm, ok := m.sources[source]; ok {
+		return sm.lastSuccess
+	}
+	return time.Time{}
+}
+
+// escapeLabelValue escapes v for use as a label value, see the Prometheus text exposition format.
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format (version 0.0.4).
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.sources))
+	for name := range m.sources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	b := &strings.Builder{}
+	header := func(name, typ, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	gauge := func(name, help string, value func(sm *sourceMetrics) (float64, bool)) {
+		header(name, "gauge", help)
+		for _, src := range names {
+			if v, ok := value(m.sources[src]); ok {
+				fmt.Fprintf(b, "%s{source=\"%s\"} %s\n", name, escapeLabelValue(src), formatFloat(v))
+			}
+		}
+	}
+
+	header("apploos_collector_fetches_total", "counter", "Number of fetches by source and outcome.")
+	outcomes := []string{OutcomeChanged, OutcomeUnchanged, OutcomeNotModified, OutcomeRejected, OutcomeError}
+	for _, src := range names {
+		for _, outcome := range outcomes {
+			fmt.Fprintf(b, "apploos_collector_fetches_total{source=\"%s\",outcome=\"%s\"} %d\n", escapeLabelValue(src), outcome, m.sources[src].fetches[outcome])
+		}
+	}
+
+	header("apploos_collector_snapshots_total", "counter", "Number of successful fetches by source and whether the contents changed.")
+	for _, src := range names {
+		sm := m.sources[src]
+		fmt.Fprintf(b, "apploos_collector_snapshots_total{source=\"%s\",change=\"changed\"} %d\n", escapeLabelValue(src), sm.fetches[OutcomeChanged])
+		fmt.Fprintf(b, "apploos_collector_snapshots_total{source=\"%s\",change=\"unchanged\"} %d\n", escapeLabelValue(src), sm.fetches[OutcomeUnchanged]+sm.fetches[OutcomeNotModified])
+	}
+
+	histogramSeries := func(name, labels string, h *histogram) {
+		for i, bound := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+		fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+
+	header("apploos_collector_fetch_duration_seconds", "histogram", "Duration of fetching and storing a source.")
+	for _, src := range names {
+		histogramSeries("apploos_collector_fetch_duration_seconds", fmt.Sprintf("source=\"%s\"", escapeLabelValue(src)), m.sources[src].duration)
+	}
+
+	header("apploos_collector_http_phase_duration_seconds", "histogram", "Duration of the phases (dns, connect, tls, ttfb and total) of successful HTTP requests by source.")
+	for _, src := range names {
+		for _, phase := range httpPhases {
+			h := m.sources[src].httpPhases[phase]
+			if h.count == 0 {
+				continue
+			}
+			histogramSeries("apploos_collector_http_phase_duration_seconds", fmt.Sprintf("source=\"%s\",phase=\"%s\"", escapeLabelValue(src), phase), h)
+		}
+	}
+
+	header("apploos_collector_fetched_bytes_total", "counter", "Number of bytes stored (or found unchanged) by source.")
+	for _, src := range names {
+		fmt.Fprintf(b, "apploos_collector_fetched_bytes_total{source=\"%s\"} %d\n", escapeLabelValue(src), m.sources[src].bytes)
+	}
+
+	gauge("apploos_collector_last_success_timestamp_seconds", "Unix time of the most recent successful fetch by source.", func(sm *sourceMetrics) (float64, bool) {
+		return float64(sm.lastSuccess.UnixNano()) / 1e9, !sm.lastSuccess.IsZero()
+	})
+	gauge("apploos_collector_retry_attempt", "Current retry attempt of a transient failure by source, 0 if not retrying.", func(sm *sourceMetrics) (float64, bool) {
+		return float64(sm.retryAttempt), true
+	})
+	gauge("apploos_collector_consecutive_failures", "Number of consecutive failed fetches (after retrying) by source.", func(sm *sourceMetrics) (float64, bool) {
+		return float64(sm.consecutiveFailures), true
+	})
+	gauge("apploos_collector_breaker_open", "Whether the circuit breaker of a source is open, i.e. it's polled slower than usual.", func(sm *sourceMetrics) (float64, bool) {
+		return boolToFloat(sm.breakerOpen), true
+	})
+	gauge("apploos_collector_next_fetch_interval_seconds", "Time between the most recent fetch and the next one by source, including backoff.", func(sm *sourceMetrics) (float64, bool) {
+		return sm.nextInterval.Seconds(), true
+	})
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// vim: cc=120:
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	NormalizeJSON = "json"
+	NormalizeICal = "ical"
+)
+
+// NormalizePolicy determines how the contents of a source are normalized before they're hashed and stored, such that
+// insignificant differences (e.g. the order of keys, or a timestamp of generation) don't result in a new snapshot. The
+// normalized contents are what is stored.
+type NormalizePolicy struct {
+	// Format is either "json" or "ical".
+	//
+	// JSON is canonicalized: keys are sorted, insignificant whitespace is removed and numbers are kept as is.
+	//
+	// iCal drops DTSTAMP properties, which hold the moment the calendar was generated rather than anything about the
+	// events. Both the text format (RFC 5545) and its XML representation (xCal, RFC 6321) are supported.
+	Format string
+	// IgnorePaths are removed from JSON before canonicalizing. A path consists of object keys and array indices
+	// separated by dots, where * matches any key or index, e.g. "generatedAt" or "items.*.lastUpdated".
+	IgnorePaths []string `json:",omitempty"`
+}
+
+// Validate checks the NormalizePolicy for consistency.
+func (p *NormalizePolicy) Validate() error {
+	switch p.Format {
+	case NormalizeJSON:
+	case NormalizeICal:
+		if len(p.IgnorePaths) > 0 {
+			return fmt.Errorf("ignore paths are only supported for format %q", NormalizeJSON)
+		}
+	default:
+		return fmt.Errorf("unsupported normalize format %q, expected %q or %q", p.Format, NormalizeJSON, NormalizeICal)
+	}
+	for _, path := range p.IgnorePaths {
+		if path == "" || strings.Contains(path, "..") || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") {
+			return fmt.Errorf("invalid ignore path %q", path)
+		}
+	}
+	return nil
+}
+
+// Normalize returns the normalized form of contents.
+func (p *NormalizePolicy) Normalize(contents []byte) ([]byte, error) {
+	switch p.Format {
+	case NormalizeJSON:
+		return normalizeJSON(contents, p.IgnorePaths)
+	case NormalizeICal:
+		return normalizeICal(contents), nil
+	}
+	return nil, fmt.Errorf("unsupported normalize format %q", p.Format)
+}
+
+func normalizeJSON(contents []byte, ignorePaths []string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data after JSON value at offset %d", dec.InputOffset())
+	}
+	for _, path := range ignorePaths {
+		deleteJSONPath(v, strings.Split(path, "."))
+	}
+
+	// Maps are marshalled with sorted keys, which is what makes the result canonical
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// deleteJSONPath removes the values at path in v. Array elements can only be descended into, not removed, as that would
+// shift the indices of the others.
+func deleteJSONPath(v any, path []string) {
+	if len(path) == 0 {
+		return
+	}
+	switch t := v.(type) {
+	case map[string]any:
+		for key, child := range t {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				delete(t, key)
+			} else {
+				deleteJSONPath(child, path[1:])
+			}
+		}
+	case []any:
+		if len(path) == 1 {
+			return
+		}
+		for i, child := range t {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				deleteJSONPath(child, path[1:])
+			}
+		}
+	}
+}
+
+// xcalDTStamp matches a dtstamp property in xCal, including the whitespace that follows it.
+var xcalDTStamp = regexp.MustCompile(`(?is)<(?:[a-z0-9_-]+:)?dtstamp\b[^>]*>.*?</(?:[a-z0-9_-]+:)?dtstamp>\s*`)
+
+func normalizeICal(contents []byte) []byte {
+	if bytes.HasPrefix(bytes.TrimSpace(contents), []byte("<")) {
+		return xcalDTStamp.ReplaceAll(contents, nil)
+	}
+
+	ret := make([]byte, 0, len(contents))
+	dropping := false
+	for _, line := range bytes.SplitAfter(contents, []byte("\n")) {
+		// Long lines are folded into continuation lines that start with whitespace, see RFC 5545 section 3.1
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if !dropping {
+				ret = append(ret, line...)
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(string(line), ":")
+		name, _, _ = strings.Cut(name, ";")
+		dropping = strings.EqualFold(strings.TrimSpace(name), "DTSTAMP")
+		if !dropping {
+			ret = append(ret, line...)
+		}
+	}
+	return ret
+}
+
+// vim: cc=120:
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		contents    string
+		ignorePaths []string
+		want        string
+	}{
+		{"sorted keys", `{"b": 1, "a": {"d": 2, "c": 3}}`, nil, `{"a":{"c":3,"d":2},"b":1}`},
+		{"whitespace", "[ 1,\n\t2 ,3 ]\n", nil, `[1,2,3]`},
+		{"numbers as is", `{"price": 1.50, "big": 12345678901234567890, "exp": 1e3}`, nil, `{"big":12345678901234567890,"exp":1e3,"price":1.50}`},
+		{"no html escaping", `{"title": "<b>Tom & Jerry</b>"}`, nil, `{"title":"<b>Tom & Jerry</b>"}`},
+		{"ignore key", `{"generatedAt": "2025-07-12T10:00:00Z", "items": []}`, []string{"generatedAt"}, `{"items":[]}`},
+		{"ignore missing key", `{"items": []}`, []string{"generatedAt", "items.0.x"}, `{"items":[]}`},
+		{
+			"ignore wildcard",
+			`{"items": [{"id": 1, "updated": "x"}, {"id": 2, "updated": "y"}]}`,
+			[]string{"items.*.updated"},
+			`{"items":[{"id":1},{"id":2}]}`,
+		},
+		{
+			"ignore index",
+			`{"items": [{"id": 1, "updated": "x"}, {"id": 2, "updated": "y"}]}`,
+			[]string{"items.1.updated"},
+			`{"items":[{"id":1,"updated":"x"},{"id":2}]}`,
+		},
+		// Array elements aren't removed, as that would shift the others
+		{"ignore array element", `{"items": [1, 2, 3]}`, []string{"items.1", "items.*"}, `{"items":[1,2,3]}`},
+		{"ignore any key", `{"a": {"x": 1, "y": 2}, "b": {"x": 3}}`, []string{"*.x"}, `{"a":{"y":2},"b":{}}`},
+	}
+	for _, test := range tests {
+		got, err := normalizeJSON([]byte(test.contents), test.ignorePaths)
+		if err != nil {
+			t.Errorf("%s: normalizeJSON failed: %v", test.name, err)
+			continue
+		}
+		if string(got) != test.want+"\n" {
+			t.Errorf("%s: normalizeJSON = %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	for _, contents := range []string{``, `{`, `{"a": 1} {"b": 2}`, `[1] x`} {
+		if _, err := normalizeJSON([]byte(contents), nil); err == nil {
+			t.Errorf("normalizeJSON(%q) succeeded, want error", contents)
+		}
+	}
+}
+
+func TestNormalizeICal(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{
+			"dtstamp",
+			"BEGIN:VEVENT\r\nUID:1\r\nDTSTAMP:20250712T100000Z\r\nSUMMARY:Start\r\nEND:VEVENT\r\n",
+			"BEGIN:VEVENT\r\nUID:1\r\nSUMMARY:Start\r\nEND:VEVENT\r\n",
+		},
+		{
+			"parameters and case",
+			"UID:1\ndtstamp;VALUE=DATE-TIME:20250712T100000Z\nSUMMARY:Start\n",
+			"UID:1\nSUMMARY:Start\n",
+		},
+		// Continuation lines belong to the property they continue
+		{
+			"folded",
+			"DTSTAMP:2025\r\n 0712T100000Z\r\nDESCRIPTION:A long\r\n  description\r\nEND:VEVENT",
+			"DESCRIPTION:A long\r\n  description\r\nEND:VEVENT",
+		},
+		{"other properties", "DTSTART:20250712T100000Z\nX-DTSTAMP:1\n", "DTSTART:20250712T100000Z\nX-DTSTAMP:1\n"},
+		{
+			"xcal",
+			"<vevent><properties>\n\t<uid><text>1</text></uid>\n\t<dtstamp><date-time>2025-07-12T10:00:00Z</date-time></dtstamp>\n\t<summary><text>Start</text></summary>\n</properties></vevent>",
+			"<vevent><properties>\n\t<uid><text>1</text></uid>\n\t<summary><text>Start</text></summary>\n</properties></vevent>",
+		},
+		{
+			"xcal namespace",
+			"<xc:vevent><xc:DTSTAMP><xc:date-time>2025-07-12T10:00:00Z</xc:date-time></xc:DTSTAMP></xc:vevent>",
+			"<xc:vevent></xc:vevent>",
+		},
+	}
+	for _, test := range tests {
+		if got := string(normalizeICal([]byte(test.contents))); got != test.want {
+			t.Errorf("%s: normalizeICal = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// vim: cc=120:
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PollPolicy adapts the interval of a source to what it's doing, and to what it says about itself. The zero value
+// polls every Source.Interval, honoring only Retry-After.
+type PollPolicy struct {
+	// UseMaxAge makes the freshness lifetime of a response (Cache-Control: max-age, minus Age) a lower bound of the
+	// time until the next fetch of the source.
+	UseMaxAge bool `json:",omitempty"`
+	// MaxHint caps the delay that a source can ask for, through Retry-After or max-age. Defaults to
+	// Breaker.MaxInterval.
+	MaxHint Duration
+
+	// HotWindows are periods in which the source is polled at least every Interval of the window, e.g. during the
+	// festival itself.
+	HotWindows []HotWindow `json:",omitempty"`
+	// After a change, the source is polled at least every RecentChangeInterval, for the duration of RecentChange.
+	RecentChange         Duration `json:",omitempty"`
+	RecentChangeInterval Duration `json:",omitempty"`
+	// Once the source has been unchanged for longer than Idle, it's polled every IdleInterval (if that's longer than
+	// Source.Interval), unless a hot window or recent change applies.
+	Idle         Duration `json:",omitempty"`
+	IdleInterval Duration `json:",omitempty"`
+}
+
+// HotWindow is a period, from Start up to End, in which a source is polled every Interval or faster.
+type HotWindow struct {
+	Start    time.Time
+	End      time.Time
+	Interval Duration
+}
+
+// Validate checks the PollPolicy for consistency.
+func (p *PollPolicy) Validate() error {
+	if p.MaxHint < 0 {
+		return fmt.Errorf("negative maximum hint %v", time.Duration(p.MaxHint))
+	}
+	for i, w := range p.HotWindows {
+		if !w.Start.Before(w.End) {
+			return fmt.Errorf("hot window #%d: start %v isn't before end %v", i, w.Start, w.End)
+		}
+		if w.Interval <= 0 {
+			return fmt.Errorf("hot window #%d: interval must be positive", i)
+		}
+	}
+	if (p.RecentChange > 0) != (p.RecentChangeInterval > 0) || p.RecentChange < 0 || p.RecentChangeInterval < 0 {
+		return fmt.Errorf("recent change and recent change interval must both be positive, or both be omitted")
+	}
+	if (p.Idle > 0) != (p.IdleInterval > 0) || p.Idle < 0 || p.IdleInterval < 0 {
+		return fmt.Errorf("idle and idle interval must both be positive, or both be omitted")
+	}
+	return nil
+}
+
+// Interval returns the interval that applies at now to a source with the given base interval and state.
+func (p *PollPolicy) Interval(base time.Duration, st SourceState, now time.Time) time.Duration {
+	interval := base
+	faster := false
+	for _, w := range p.HotWindows {
+		if !now.Before(w.Start) && now.Before(w.End) && time.Duration(w.Interval) < interval {
+			interval, faster = time.Duration(w.Interval), true
+		}
+	}
+	if p.RecentChange > 0 && !st.LastChanged.IsZero() && now.Sub(st.LastChanged) < time.Duration(p.RecentChange) && time.Duration(p.RecentChangeInterval) < interval {
+		interval, faster = time.Duration(p.RecentChangeInterval), true
+	}
+	if !faster && p.Idle > 0 && !st.LastChanged.IsZero() && now.Sub(st.LastChanged) > time.Duration(p.Idle) && time.Duration(p.IdleInterval) > interval {
+		interval = time.Duration(p.IdleInterval)
+	}
+	return interval
+}
+
+// hint caps the delay d that a source asked for at MaxHint.
+func (p *PollPolicy) hint(d time.Duration) time.Duration {
+	if p.MaxHint > 0 && d > time.Duration(p.MaxHint) {
+		return time.Duration(p.MaxHint)
+	}
+	return d
+}
+
+// NextInterval returns the interval until the next fetch of the source in state st, with a random jitter of up to
+// (-)Jitter applied (see Source.JitterFor). It follows the Schedule of the source if it has one, in which case the
+// jitter only delays, and it returns false if the schedule has no more fetches. Otherwise it's the Interval, adapted
+// according to the PollPolicy.
+func (s *Source) NextInterval(st SourceState) (time.Duration, bool) {
+	now := time.Now()
+	if len(s.Schedule) > 0 {
+		next, ok := s.Schedule.Next(now)
+		if !ok {
+			return 0, false
+		}
+		interval := next.Sub(now)
+		if jitter := s.JitterFor(interval); jitter > 0 {
+			interval += time.Duration(rand.Int63n(int64(jitter)))
+		}
+		return interval, true
+	}
+	interval := s.Poll.Interval(time.Duration(s.Interval), st, now)
+	jitterSeconds := int(s.JitterFor(interval).Seconds())
+	if jitterSeconds <= 0 {
+		return interval, true
+	}
+	return interval + time.Duration(-jitterSeconds+rand.Intn(2*jitterSeconds))*time.Second, true
+}
+
+// FirstDelay returns the time until the first fetch of the source in state st, after starting the collector. It's a
+// random part of the Jitter, such that the first fetches of all sources are spread. A source with a Schedule waits for
+// its next fetch since it was last seen, or since now if it was never seen and no rule applies now. It returns false if
+// the schedule has no more fetches.
+func (s *Source) FirstDelay(st SourceState) (time.Duration, bool) {
+	now := time.Now()
+	if len(s.Schedule) > 0 && (!st.LastSeen.IsZero() || s.Schedule.active(now) < 0) {
+		last := st.LastSeen
+		if last.IsZero() {
+			last = now
+		}
+		next, ok := s.Schedule.Next(last)
+		if !ok {
+			return 0, false
+		}
+		return max(0, next.Sub(now)), true
+	}
+	jitter := s.JitterFor(s.Poll.Interval(time.Duration(s.Interval), st, now))
+	if jitter <= 0 {
+		return 0, true
+	}
+	return time.Duration(rand.Int63n(int64(jitter))), true
+}
+
+// JitterFor returns the Jitter to apply to interval: Jitter itself, but at most half the interval, such that a fast hot
+// window isn't overwhelmed by it.
+func (s *Source) JitterFor(interval time.Duration) time.Duration {
+	if s.Jitter == nil {
+		return 0
+	}
+	return min(time.Duration(*s.Jitter), interval/2)
+}
+
+// parseRetryAfter returns the delay of a Retry-After header value, which is either a number of seconds or an HTTP date,
+// or 0 if it's missing or invalid.
+func parseRetryAfter(val string, now time.Time) time.Duration {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(val); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// parseMaxAge returns the remaining freshness lifetime of a response with the given headers: Cache-Control max-age
+// minus Age. It's 0 if there is none, or if the response mustn't be reused without revalidation (no-cache, no-store).
+func parseMaxAge(header http.Header) time.Duration {
+	maxAge := -1
+	for _, directive := range strings.Split(strings.Join(header.Values("cache-control"), ","), ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return 0
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(val, `"`)); err == nil && seconds >= 0 {
+				maxAge = seconds
+			}
+		}
+	}
+	if maxAge <= 0 {
+		return 0
+	}
+	if age, err := strconv.Atoi(strings.TrimSpace(header.Get("age"))); err == nil && age > 0 {
+		maxAge -= age
+	}
+	if maxAge <= 0 {
+		return 0
+	}
+	return time.Duration(maxAge) * time.Second
+}
+
+// vim: cc=120:
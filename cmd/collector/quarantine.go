@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mrngm/apploos/util"
+)
+
+const QuarantineDirName = "quarantine"
+
+// Quarantine saves the body of a rejected response in the quarantine subdirectory of saveDir, outside of the reach of
+// the processor. The filename contains the time of rejection, the reason and the checksum of body. It returns the path
+// of the saved body.
+func Quarantine(ctx context.Context, saveDir string, src string, rejected RejectedError) (string, error) {
+	reason, body := rejected.Rejected()
+	dir := filepath.Join(saveDir, QuarantineDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Error("cannot create quarantine directory", "err", err, "dir", dir)
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s-%s-%x.blob", time.Now().UTC().Format("20060102T150405Z"), reason, sha256.Sum256(body))
+	written, err := util.SaveToDisk(ctx, dir, name, body, true, false)
+	if err != nil {
+		slog.Error("failed saving to quarantine", "err", err, "src", src, "dir", dir, "fn", name)
+		return "", err
+	}
+	slog.Warn("quarantined response", "src", src, "reason", reason, "rejection", rejected.Error(), "fn", filepath.Join(dir, name), "written", written)
+	return filepath.Join(dir, name), nil
+}
+
+// vim: cc=120:
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/mrngm/apploos/util"
+)
+
+// RetentionPolicy determines which snapshots of a source are kept when pruning its storage directory. Snapshots are
+// ordered by the fetch time in their metadata (see util.SnapshotMeta). The most recent KeepLast snapshots are kept,
+// and beyond those the most recent snapshot of each of the KeepHourly most recent hours, and of each of the KeepDaily
+// most recent days. The latest snapshot is never pruned.
+//
+// A policy in which no field is positive keeps everything, which is the default. A negative field keeps no snapshots by
+// that rule, e.g. to override a default given on the command line.
+type RetentionPolicy struct {
+	// KeepLast defaults to -keepLast, KeepHourly to -keepHourly and KeepDaily to -keepDaily.
+	KeepLast   int
+	KeepHourly int
+	KeepDaily  int
+}
+
+// Enabled reports whether the policy prunes anything at all.
+func (p RetentionPolicy) Enabled() bool {
+	return p.KeepLast > 0 || p.KeepHourly > 0 || p.KeepDaily > 0
+}
+
+// Prune returns the snapshots of metas that the policy doesn't keep. Snapshots of which the checksum is in protected
+// are kept regardless. metas should contain the snapshots of a single source.
+func (p RetentionPolicy) Prune(metas []util.SnapshotMeta, protected map[string]struct{}) []util.SnapshotMeta {
+	if !p.Enabled() || len(metas) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(metas)
+	slices.SortFunc(sorted, func(a, b util.SnapshotMeta) int {
+		return b.FetchEnd.Compare(a.FetchEnd)
+	})
+
+	keep := make([]bool, len(sorted))
+	// The latest snapshot is what the processor picks up, so it's always kept
+	keep[0] = true
+	for i := 0; i < p.KeepLast && i < len(sorted); i++ {
+		keep[i] = true
+	}
+	keepPerBucket := func(n int, bucket func(time.Time) string) {
+		seen := ""
+		for i := 0; i < len(sorted) && n > 0; i++ {
+			b := bucket(sorted[i].FetchEnd.Local())
+			if b == seen {
+				continue
+			}
+			seen = b
+			keep[i] = true
+			n--
+		}
+	}
+	keepPerBucket(p.KeepHourly, func(t time.Time) string { return t.Format("2006010215") })
+	keepPerBucket(p.KeepDaily, func(t time.Time) string { return t.Format("20060102") })
+
+	ret := make([]util.SnapshotMeta, 0)
+	for i, meta := range sorted {
+		if _, ok := protected[meta.Checksum]; ok || keep[i] {
+			continue
+		}
+		ret = append(ret, meta)
+	}
+	return ret
+}
+
+// PruneSnapshots deletes the snapshots of source in store that policy doesn't keep, or only logs them if dryRun is
+// given. It returns the number of (to be) pruned snapshots.
+func PruneSnapshots(ctx context.Context, store util.Store, source string, policy RetentionPolicy, protected map[string]struct{}, dryRun bool) (int, error) {
+	if !policy.Enabled() {
+		return 0, nil
+	}
+	metas, err := store.List(ctx, source)
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	var errs []error
+	for _, meta := range policy.Prune(metas, protected) {
+		if dryRun {
+			slog.Info("would prune snapshot", "src", source, "checksum", meta.Checksum, "fetchEnd", meta.FetchEnd)
+			pruned++
+			continue
+		}
+		if err := store.Delete(ctx, source, meta.Checksum); err != nil {
+			slog.Error("cannot prune snapshot", "err", err, "src", source, "checksum", meta.Checksum)
+			errs = append(errs, err)
+			continue
+		}
+		slog.Debug("pruned snapshot", "src", source, "checksum", meta.Checksum, "fetchEnd", meta.FetchEnd)
+		pruned++
+	}
+	if pruned > 0 {
+		slog.Info("pruned snapshots", "src", source, "pruned", pruned, "snapshots", len(metas), "dryRun", dryRun)
+	}
+	return pruned, errors.Join(errs...)
+}
+
+// prune implements the prune subcommand: it applies the retention policy of every configured source once and exits.
+func prune(args []string) int {
+	pruneFlags := subcommandFlags("prune")
+	dryRun := pruneFlags.Bool("dryRun", false, "Only log which snapshots would be pruned")
+	pruneFlags.Parse(args)
+	logger := setupLogger()
+
+	if *saveDir == "" {
+		logger.Error("please provide -storage to prune")
+		return 1
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Error("invalid configuration", "err", err)
+		return 1
+	}
+	state, err := LoadStateStore(*saveDir)
+	if err != nil {
+		logger.Error("cannot load collector state", "err", err, "dir", *saveDir)
+		return 1
+	}
+
+	exitCode := 0
+	protected := state.Checksums()
+	for _, src := range cfg.Sources {
+		if !src.Retention.Enabled() {
+			logger.Info("no retention policy, keeping all snapshots", "src", src.Name)
+			continue
+		}
+		store := util.NewFSStore(filepath.Join(*saveDir, src.Storage), *cleanupTmp)
+		if _, err := PruneSnapshots(context.Background(), store, src.Name, src.Retention, protected, *dryRun); err != nil {
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
+
+// vim: cc=120:
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mrngm/apploos/util"
+)
+
+// localTime returns the time in the local time zone, in which cron expressions and schedules are evaluated.
+func localTime(year int, month time.Month, day, hour, min int) time.Time {
+	return time.Date(year, month, day, hour, min, 0, 0, time.Local)
+}
+
+func TestRetentionPolicyPrune(t *testing.T) {
+	// Snapshots named after the moment they were fetched, oldest first
+	metas := []util.SnapshotMeta{}
+	for _, at := range []time.Time{
+		localTime(2025, 7, 10, 9, 0),
+		localTime(2025, 7, 11, 9, 0),
+		localTime(2025, 7, 11, 10, 10),
+		localTime(2025, 7, 11, 10, 40),
+		localTime(2025, 7, 11, 11, 20),
+		localTime(2025, 7, 11, 11, 50),
+		localTime(2025, 7, 11, 12, 5),
+	} {
+		metas = append(metas, util.SnapshotMeta{Checksum: at.Format("0102-1504"), FetchEnd: at})
+	}
+	tests := []struct {
+		name      string
+		policy    RetentionPolicy
+		protected []string
+		want      []string
+	}{
+		{"disabled", RetentionPolicy{}, nil, nil},
+		{"negative", RetentionPolicy{KeepLast: -1, KeepDaily: -1}, nil, nil},
+		{"last", RetentionPolicy{KeepLast: 3}, nil, []string{"0711-1040", "0711-1010", "0711-0900", "0710-0900"}},
+		{"last more than there are", RetentionPolicy{KeepLast: 10}, nil, []string{}},
+		{"protected", RetentionPolicy{KeepLast: 3}, []string{"0711-1040", "0710-0900"}, []string{"0711-1010", "0711-0900"}},
+		// The most recent snapshot of every hour
+		{"hourly", RetentionPolicy{KeepHourly: 2}, nil, []string{"0711-1120", "0711-1040", "0711-1010", "0711-0900", "0710-0900"}},
+		{"hourly gap", RetentionPolicy{KeepHourly: 4}, nil, []string{"0711-1120", "0711-1010", "0710-0900"}},
+		{"daily", RetentionPolicy{KeepDaily: 2}, nil, []string{"0711-1150", "0711-1120", "0711-1040", "0711-1010", "0711-0900"}},
+		{"combined", RetentionPolicy{KeepLast: 2, KeepHourly: 3, KeepDaily: 2}, nil, []string{"0711-1120", "0711-1010", "0711-0900"}},
+		// The latest snapshot is kept by any policy that is enabled
+		{"latest", RetentionPolicy{KeepLast: -1, KeepDaily: 1}, nil, []string{"0711-1150", "0711-1120", "0711-1040", "0711-1010", "0711-0900", "0710-0900"}},
+	}
+	for _, test := range tests {
+		protected := make(map[string]struct{})
+		for _, checksum := range test.protected {
+			protected[checksum] = struct{}{}
+		}
+		// The order of metas doesn't matter
+		shuffled := slices.Clone(metas)
+		slices.Reverse(shuffled[2:])
+		var got []string
+		if pruned := test.policy.Prune(shuffled, protected); pruned != nil {
+			got = []string{}
+			for _, meta := range pruned {
+				got = append(got, meta.Checksum)
+			}
+		}
+		if !slices.Equal(got, test.want) || (got == nil) != (test.want == nil) {
+			t.Errorf("%s: Prune = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// vim: cc=120:
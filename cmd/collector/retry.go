@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Backoff computes capped exponential backoff durations with full jitter: attempt n waits a random duration between 0
+// and min(Max, Base * 2^n).
+type Backoff struct {
+	Base Duration
+	Max  Duration
+}
+
+// Duration returns the time to wait before the given attempt, counting from zero.
+func (b Backoff) Duration(attempt int) time.Duration {
+	ceiling := time.Duration(b.Base)
+	for i := 0; i < attempt && ceiling < time.Duration(b.Max); i++ {
+		ceiling *= 2
+	}
+	if ceiling > time.Duration(b.Max) {
+		ceiling = time.Duration(b.Max)
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// RetryPolicy determines how often, and how fast, a transient failure of a source is retried before waiting for the
+// next interval.
+type RetryPolicy struct {
+	// Attempts is the number of retries after the first failure. Defaults to -retries, a negative value disables
+	// retrying.
+	Attempts int
+	// Backoff defaults to -retryBase and -retryMax.
+	Backoff Backoff
+}
+
+// BreakerPolicy configures the CircuitBreaker of a source.
+type BreakerPolicy struct {
+	// Threshold is the number of consecutive failed fetches (after retrying) that opens the breaker. Defaults to
+	// -breakerThreshold.
+	Threshold int
+	// MaxInterval caps the slowed down interval of an open breaker. Defaults to -breakerMaxInterval.
+	MaxInterval Duration
+}
+
+// IsTransient reports whether err is a failure that is likely to go away by itself, such as a timeout, a connection
+// reset, a DNS hiccup or a 5xx response. Other failures, such as 4xx responses, rejected content or an unsupported
+// protocol, are considered permanent: retrying them right away won't help.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode == http.StatusRequestTimeout
+	}
+	for _, errno := range []syscall.Errno{syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED, syscall.EPIPE, syscall.ETIMEDOUT, syscall.EHOSTUNREACH, syscall.ENETUNREACH} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// CircuitBreaker slows down polling of a source that keeps failing. After Threshold consecutive failures it opens,
+// and every further failure doubles the interval, up to MaxInterval. A single success closes it again. It's safe for
+// use by multiple goroutines.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	policy   BreakerPolicy
+	failures int
+}
+
+func NewCircuitBreaker(policy BreakerPolicy) *CircuitBreaker {
+	return &CircuitBreaker{
+		policy: policy,
+	}
+}
+
+// Success closes the breaker.
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures = 0
+}
+
+// Failure records a failed fetch and returns the number of consecutive failures.
+func (cb *CircuitBreaker) Failure() int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	return cb.failures
+}
+
+// Failures returns the number of consecutive failures.
+func (cb *CircuitBreaker) Failures() int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.failures
+}
+
+// Open reports whether the breaker is open, i.e. whether the source is being polled slower than usual.
+func (cb *CircuitBreaker) Open() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.policy.Threshold > 0 && cb.failures >= cb.policy.Threshold
+}
+
+// Interval returns the interval to use instead of interval, which is interval itself if the breaker is closed.
+func (cb *CircuitBreaker) Interval(interval time.Duration) time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.policy.Threshold <= 0 || cb.failures < cb.policy.Threshold {
+		return interval
+	}
+	slowed := interval
+	for i := cb.policy.Threshold; i <= cb.failures && slowed < time.Duration(cb.policy.MaxInterval); i++ {
+		slowed *= 2
+	}
+	if slowed > time.Duration(cb.policy.MaxInterval) {
+		slowed = time.Duration(cb.policy.MaxInterval)
+	}
+	if slowed < interval {
+		return interval
+	}
+	return slowed
+}
+
+// vim: cc=120:
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// SanityPolicy holds the checks a snapshot must pass before it's stored as the latest one of a source, such that an
+// upstream hiccup (e.g. an empty program) doesn't end up in the published schedule. A snapshot that fails is
+// quarantined instead, and the AlertHooks are notified.
+type SanityPolicy struct {
+	// MinBytes is the minimum size of a snapshot.
+	MinBytes int64 `json:",omitempty"`
+	// MaxShrinkPercent is how much smaller, in percent of the size of the previous snapshot, a snapshot may be. It's
+	// not checked when 0.
+	MaxShrinkPercent float64 `json:",omitempty"`
+	// MinCounts maps paths in JSON contents, in the notation of Pagination.ItemsPath, to the minimum number of
+	// elements of the array (or keys of the object) at that path, e.g. {"Programs": 100, "Locations": 20, "Days": 4}
+	// for the Vierdaagse. A missing path counts as 0. Object keys match case-insensitively, like they do when the
+	// processor decodes the contents.
+	MinCounts map[string]int `json:",omitempty"`
+	// AlertHooks are notified when a snapshot fails, with a ChangeEvent of type EventSanity. Failures are logged
+	// regardless.
+	AlertHooks []*Hook `json:",omitempty"`
+}
+
+// SanityError is returned when the contents of a source fail a check of its SanityPolicy.
+type SanityError struct {
+	URL string
+	// Check is the check that failed: "min-bytes", "max-shrink", "min-count" or "json".
+	Check string
+	Err   error
+	Body  []byte
+}
+
+func (e *SanityError) Error() string {
+	return fmt.Sprintf("%s failed sanity check %s: %v", e.URL, e.Check, e.Err)
+}
+
+func (e *SanityError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SanityError) Rejected() (string, []byte) {
+	return "sanity-" + e.Check, e.Body
+}
+
+// Validate checks the SanityPolicy for consistency, including its hooks.
+func (p *SanityPolicy) Validate() error {
+	if p.MinBytes < 0 {
+		return fmt.Errorf("negative minimum size %d", p.MinBytes)
+	}
+	if p.MaxShrinkPercent < 0 || p.MaxShrinkPercent > 100 {
+		return fmt.Errorf("maximum shrink percentage %v should be in [0, 100]", p.MaxShrinkPercent)
+	}
+	for path, count := range p.MinCounts {
+		if err := validJSONPath(path); err != nil {
+			return err
+		}
+		if count < 0 {
+			return fmt.Errorf("negative minimum count %d for %q", count, path)
+		}
+	}
+	for i, hook := range p.AlertHooks {
+		if hook == nil {
+			return fmt.Errorf("alert hook #%d is empty", i)
+		}
+		if err := hook.Validate(); err != nil {
+			return fmt.Errorf("alert hook #%d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Check returns a *SanityError if contents of url fail a check, where prevSize is the size of the previous snapshot (0
+// if there is none).
+func (p *SanityPolicy) Check(url string, contents []byte, prevSize int64) error {
+	size := int64(len(contents))
+	if size < p.MinBytes {
+		return &SanityError{URL: url, Check: "min-bytes", Err: fmt.Errorf("%d bytes, expected at least %d", size, p.MinBytes), Body: contents}
+	}
+	if p.MaxShrinkPercent > 0 && prevSize > 0 && size < prevSize {
+		shrink := float64(prevSize-size) / float64(prevSize) * 100
+		if shrink > p.MaxShrinkPercent {
+			return &SanityError{URL: url, Check: "max-shrink", Err: fmt.Errorf("shrunk %.1f%% from %d to %d bytes, allowed is %v%%", shrink, prevSize, size, p.MaxShrinkPercent), Body: contents}
+		}
+	}
+	if len(p.MinCounts) == 0 {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return &SanityError{URL: url, Check: "json", Err: err, Body: contents}
+	}
+	// Check the paths in a stable order, such that the same contents always fail the same way
+	paths := make([]string, 0, len(p.MinCounts))
+	for path := range p.MinCounts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		count := 0
+		found, _ := lookupJSONPath(v, path, true)
+		switch t := found.(type) {
+		case []any:
+			count = len(t)
+		case map[string]any:
+			count = len(t)
+		}
+		if count < p.MinCounts[path] {
+			return &SanityError{URL: url, Check: "min-count", Err: fmt.Errorf("%d elements at %q, expected at least %d", count, path, p.MinCounts[path]), Body: contents}
+		}
+	}
+	return nil
+}
+
+// vim: cc=120:
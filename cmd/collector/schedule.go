@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ScheduleTime is a moment in a schedule, written in JSON either as an RFC 3339 time or as a date (2006-01-02), which
+// is midnight in the local time zone of the collector.
+type ScheduleTime struct {
+	time.Time
+	// dateOnly tells whether only a date was given.
+	dateOnly bool
+}
+
+func (t ScheduleTime) MarshalJSON() ([]byte, error) {
+	if t.dateOnly {
+		return json.Marshal(t.Format(time.DateOnly))
+	}
+	return json.Marshal(t.Format(time.RFC3339))
+}
+
+func (t *ScheduleTime) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("schedule time should be a string like \"2025-07-12\": %v", err)
+	}
+	if parsed, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		*t = ScheduleTime{Time: parsed, dateOnly: true}
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return fmt.Errorf("schedule time %q is neither a date nor an RFC 3339 time", s)
+	}
+	*t = ScheduleTime{Time: parsed}
+	return nil
+}
+
+// ScheduleRule says when a source is fetched, either every Every or at the times that match the cron expression Cron,
+// optionally only within the window From up to Until. An Until that is a date includes that whole day.
+type ScheduleRule struct {
+	From  *ScheduleTime `json:",omitempty"`
+	Until *ScheduleTime `json:",omitempty"`
+	Every Duration      `json:",omitempty"`
+	Cron  string        `json:",omitempty"`
+
+	cron *CronExpr
+}
+
+// Schedule is a list of rules, of which the first one whose window contains a moment applies at that moment, e.g.
+//
+//	[
+//		{"From": "2025-07-12", "Until": "2025-07-20", "Every": "1m"},
+//		{"Cron": "0 */6 * * *"}
+//	]
+//
+// to fetch every minute during the festival, and every 6 hours otherwise. The last rule usually has no window. A
+// source isn't fetched at moments that no rule applies to.
+type Schedule []*ScheduleRule
+
+// Validate checks the Schedule for consistency, and parses the cron expressions.
+func (s Schedule) Validate() error {
+	for i, rule := range s {
+		if rule == nil {
+			return fmt.Errorf("schedule rule #%d is empty", i)
+		}
+		if (rule.Every != 0) == (rule.Cron != "") {
+			return fmt.Errorf("schedule rule #%d needs either every or cron", i)
+		}
+		if rule.Every < 0 {
+			return fmt.Errorf("schedule rule #%d: negative every %v", i, time.Duration(rule.Every))
+		}
+		if rule.Cron != "" {
+			cron, err := ParseCron(rule.Cron)
+			if err != nil {
+				return fmt.Errorf("schedule rule #%d: %v", i, err)
+			}
+			rule.cron = cron
+		}
+		if rule.From != nil && rule.Until != nil && !rule.From.Before(rule.until()) {
+			return fmt.Errorf("schedule rule #%d: from %v isn't before until %v", i, rule.From.Time, rule.until())
+		}
+	}
+	return nil
+}
+
+// until returns the (exclusive) end of the window of the rule, or the zero time if it has none.
+func (r *ScheduleRule) until() time.Time {
+	if r.Until == nil {
+		return time.Time{}
+	}
+	if r.Until.dateOnly {
+		return r.Until.AddDate(0, 0, 1)
+	}
+	return r.Until.Time
+}
+
+// contains reports whether t lies within the window of the rule.
+func (r *ScheduleRule) contains(t time.Time) bool {
+	if r.From != nil && t.Before(r.From.Time) {
+		return false
+	}
+	if until := r.until(); !until.IsZero() && !t.Before(until) {
+		return false
+	}
+	return true
+}
+
+// tick returns the first tick of the rule at or after t, given that the previous fetch was at last.
+func (r *ScheduleRule) tick(last, t time.Time) time.Time {
+	if r.cron != nil {
+		return r.cron.Next(t.Add(-time.Nanosecond))
+	}
+	if next := last.Add(time.Duration(r.Every)); next.After(t) {
+		return next
+	}
+	return t
+}
+
+// active returns the index of the rule that applies at t, or -1 if none does.
+func (s Schedule) active(t time.Time) int {
+	for i, rule := range s {
+		if rule.contains(t) {
+			return i
+		}
+	}
+	return -1
+}
+
+// boundary returns the first moment after t at which the rule applying at t (the one with index idx, or none if it's
+// -1) might stop applying: when its window ends, or when the window of a rule before it opens. It's the zero time if
+// there is no such moment.
+func (s Schedule) boundary(t time.Time, idx int) time.Time {
+	var ret time.Time
+	earliest := func(b time.Time) {
+		if b.After(t) && (ret.IsZero() || b.Before(ret)) {
+			ret = b
+		}
+	}
+	for i, rule := range s {
+		if idx >= 0 && i > idx {
+			break
+		}
+		if i == idx {
+			earliest(rule.until())
+			continue
+		}
+		if rule.From != nil {
+			earliest(rule.From.Time)
+		}
+		// A rule with a window that starts before t, but isn't active yet, cannot become active later on
+	}
+	return ret
+}
+
+// Next returns the first moment after last at which the source should be fetched again, or false if there is none.
+func (s Schedule) Next(last time.Time) (time.Time, bool) {
+	t := last.Add(time.Nanosecond)
+	// Every iteration crosses a window boundary, of which there are at most two per rule
+	for i := 0; i <= 2*len(s); i++ {
+		idx := s.active(t)
+		boundary := s.boundary(t, idx)
+		if idx < 0 {
+			if boundary.IsZero() {
+				return time.Time{}, false
+			}
+			t = boundary
+			continue
+		}
+		tick := s[idx].tick(last, t)
+		if tick.IsZero() || (!boundary.IsZero() && !tick.Before(boundary)) {
+			if boundary.IsZero() {
+				return time.Time{}, false
+			}
+			t = boundary
+			continue
+		}
+		return tick, true
+	}
+	return time.Time{}, false
+}
+
+// vim: cc=120:
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// parseSchedule unmarshals and validates the Schedule in s.
+func parseSchedule(t *testing.T, s string) Schedule {
+	t.Helper()
+	var sched Schedule
+	if err := json.Unmarshal([]byte(s), &sched); err != nil {
+		t.Fatalf("cannot unmarshal schedule %s: %v", s, err)
+	}
+	if err := sched.Validate(); err != nil {
+		t.Fatalf("invalid schedule %s: %v", s, err)
+	}
+	return sched
+}
+
+func TestScheduleNext(t *testing.T) {
+	festival := `[
+		{"From": "2025-07-12", "Until": "2025-07-20", "Every": "1m"},
+		{"Cron": "0 */6 * * *"}
+	]`
+	tests := []struct {
+		name     string
+		schedule string
+		last     time.Time
+		want     time.Time
+		ok       bool
+	}{
+		{"before window", festival, localTime(2025, 7, 11, 13, 0), localTime(2025, 7, 11, 18, 0), true},
+		{"window opens", festival, localTime(2025, 7, 11, 23, 0), localTime(2025, 7, 12, 0, 0), true},
+		{"in window", festival, localTime(2025, 7, 15, 10, 0), localTime(2025, 7, 15, 10, 1), true},
+		// An Until that is a date includes that whole day
+		{"until day", festival, localTime(2025, 7, 20, 12, 0), localTime(2025, 7, 20, 12, 1), true},
+		{"until day end", festival, localTime(2025, 7, 20, 23, 58), localTime(2025, 7, 20, 23, 59), true},
+		{"window closes", festival, localTime(2025, 7, 20, 23, 59).Add(30 * time.Second), localTime(2025, 7, 21, 0, 0), true},
+		{"after window", festival, localTime(2025, 7, 21, 0, 0), localTime(2025, 7, 21, 6, 0), true},
+		{
+			"until time excludes",
+			`[{"Until": "2025-07-20T12:00:00Z", "Every": "1h"}]`,
+			time.Date(2025, 7, 20, 10, 30, 0, 0, time.UTC),
+			time.Date(2025, 7, 20, 11, 30, 0, 0, time.UTC),
+			true,
+		},
+		{"until time passed", `[{"Until": "2025-07-20T12:00:00Z", "Every": "1h"}]`, time.Date(2025, 7, 20, 11, 30, 0, 0, time.UTC), time.Time{}, false},
+		{"no rule after window", `[{"From": "2025-07-12", "Until": "2025-07-20", "Every": "1m"}]`, localTime(2025, 7, 21, 0, 0), time.Time{}, false},
+		{"no rule before window", `[{"From": "2025-07-12", "Every": "1m"}]`, localTime(2025, 7, 1, 0, 0), localTime(2025, 7, 12, 0, 0), true},
+		{"cron never matches", `[{"Cron": "0 0 30 2 *"}]`, localTime(2025, 7, 1, 0, 0), time.Time{}, false},
+		{"every waits for last", `[{"Every": "1h"}]`, localTime(2025, 7, 1, 10, 15), localTime(2025, 7, 1, 11, 15), true},
+	}
+	for _, test := range tests {
+		sched := parseSchedule(t, test.schedule)
+		got, ok := sched.Next(test.last)
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("%s: Next(%v) = %v, %v, want %v, %v", test.name, test.last, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	for _, s := range []string{
+		`[null]`,
+		`[{}]`,
+		`[{"Every": "1m", "Cron": "@daily"}]`,
+		`[{"Every": "-1m"}]`,
+		`[{"Cron": "* * *"}]`,
+		`[{"From": "2025-07-20", "Until": "2025-07-12", "Every": "1m"}]`,
+		`[{"From": "2025-07-20T12:00:00Z", "Until": "2025-07-20T12:00:00Z", "Every": "1m"}]`,
+	} {
+		var sched Schedule
+		if err := json.Unmarshal([]byte(s), &sched); err != nil {
+			t.Errorf("cannot unmarshal schedule %s: %v", s, err)
+			continue
+		}
+		if err := sched.Validate(); err == nil {
+			t.Errorf("schedule %s is valid, want error", s)
+		}
+	}
+	// A window of a single day is fine, as the Until date includes that day
+	parseSchedule(t, `[{"From": "2025-07-12", "Until": "2025-07-12", "Every": "1m"}]`)
+}
+
+// vim: cc=120:
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// NewHandler returns the HTTP handler for the -listen address of the collector:
+//
+//   - /healthz responds 200 as long as the process is able to respond at all.
+//   - /readyz responds 200 while the collector schedules fetches, and 503 before it started or once it's shutting down.
+//     The body lists the sources with the moment of their most recent successful fetch.
+//   - /metrics responds with the Metrics in the Prometheus text exposition format.
+func NewHandler(c *Collector) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		if !c.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "not ready")
+			return
+		}
+		fmt.Fprintln(w, "ready")
+		for _, name := range c.Sources() {
+			lastSuccess := "never"
+			if t := c.Metrics().LastSuccess(name); !t.IsZero() {
+				lastSuccess = t.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "source %q last success %s\n", name, lastSuccess)
+		}
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+		if _, err := c.Metrics().WriteTo(w); err != nil {
+			slog.Debug("writing metrics failed", "err", err, "remote", r.RemoteAddr)
+		}
+	})
+	return mux
+}
+
+// Serve serves NewHandler on addr until ctx is done.
+func Serve(ctx context.Context, addr string, c *Collector) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           NewHandler(c),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("shutting down listener failed", "err", err, "addr", addr)
+		}
+	}()
+	slog.Info("listening", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("listening failed", "err", err, "addr", addr)
+		return err
+	}
+	return nil
+}
+
+// vim: cc=120:
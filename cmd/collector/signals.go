@@ -2,26 +2,56 @@ package main
 
 import (
 	"context"
+	"log/slog"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
-func HandleSignals(ctx context.Context, shutdownCh chan struct{}) {
+// SignalHandlers are called by HandleSignals, one at a time.
+type SignalHandlers struct {
+	// Shutdown is called upon the first SIGINT or SIGTERM. A second one exits the process right away.
+	Shutdown func()
+	// Reload is called upon SIGHUP, which is ignored if Reload is nil.
+	Reload func()
+	// FetchNow is called upon SIGUSR1.
+	FetchNow func()
+}
+
+// HandleSignals dispatches the signals the collector reacts to, until ctx is done.
+func HandleSignals(ctx context.Context, handlers SignalHandlers) {
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	defer signal.Stop(sigCh)
+
+	shuttingDown := false
+	for {
+		var sig os.Signal
+		select {
+		case <-ctx.Done():
+			return
+		case sig = <-sigCh:
+		}
+		slog.Info("received signal", "signal", sig)
 
-sigLoop:
-	for sig := range sigCh {
 		switch sig {
-		case os.Interrupt:
-			close(shutdownCh)
-			break sigLoop
-		default:
-			// Ignore received signal
+		case os.Interrupt, syscall.SIGTERM:
+			if shuttingDown {
+				slog.Error("received second shutdown signal, exiting right away", "signal", sig)
+				os.Exit(1)
+			}
+			shuttingDown = true
+			handlers.Shutdown()
+		case syscall.SIGHUP:
+			if handlers.Reload == nil {
+				slog.Warn("cannot reload, ignoring signal", "signal", sig)
+				break
+			}
+			handlers.Reload()
+		case syscall.SIGUSR1:
+			handlers.FetchNow()
 		}
 	}
-	signal.Stop(sigCh)
-	close(sigCh)
 }
 
 // vim: cc=120:
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Source describes a single source the collector fetches, together with the expectations of what it returns. See
+// Config for how sources are configured.
+type Source struct {
+	// Name identifies the source in logs and in the collector state. Defaults to URL.
+	Name string
+	// URL of the source, prefixed with protocol:// (see Protocols)
+	URL string
+	// Interval and Jitter determine when the source is fetched again, e.g. every 5m (interval) +/- 23s (jitter).
+	// Jitter's granularity is seconds, and it's at most half the interval (see JitterFor). Default to -interval and
+	// -jitter; "0s" turns jitter off.
+	Interval Duration
+	Jitter   *Duration `json:",omitempty"`
+	// Watch polls a file:// source every duration and fetches as soon as it changes, in addition to Interval.
+	Watch Duration `json:",omitempty"`
+	// Storage is the subdirectory of -storage where the results of this source are stored. Defaults to -storage
+	// itself.
+	Storage string `json:",omitempty"`
+	// ExpectContentType is a comma separated list of acceptable media types, e.g. "application/json". Responses of
+	// another type are quarantined. Only applies to http:// and https:// sources, and is ignored when empty. Defaults to
+	// -expectContentType.
+	ExpectContentType string `json:",omitempty"`
+	// MaxSize is the maximum number of bytes that is stored for a single fetch. Larger contents are discarded. Defaults
+	// to -maxSize.
+	MaxSize int64 `json:",omitempty"`
+	// Normalize, if given, normalizes the contents before they're hashed and stored. The contents are then kept in
+	// memory (up to MaxSize) instead of streamed to disk.
+	Normalize *NormalizePolicy `json:",omitempty"`
+
+	// Retry determines how transient failures are retried, Breaker how polling slows down when the source keeps
+	// failing.
+	Retry   RetryPolicy
+	Breaker BreakerPolicy
+	// Retention determines which snapshots are kept after storing a new one.
+	Retention RetentionPolicy
+	// Poll adapts Interval to the source, see PollPolicy.
+	Poll PollPolicy
+	// Schedule, if given, determines when the source is fetched instead of Interval, see Schedule. Jitter still
+	// applies, but only delays fetches.
+	Schedule Schedule `json:",omitempty"`
+	// Hooks are notified when the source changes.
+	Hooks []*Hook `json:",omitempty"`
+	// Sanity, if given, checks the contents (after normalizing) before they're stored as the latest snapshot.
+	Sanity *SanityPolicy `json:",omitempty"`
+
+	// Args are the arguments of the command of an exec:// source. It's run with APPLOOS_SOURCE set to Name.
+	Args []string `json:",omitempty"`
+	// Timeout limits a single fetch of an http://, https:// or exec:// source, including reading the contents.
+	// Defaults to -timeout.
+	Timeout Duration
+	// Transport and Session configure how http:// and https:// sources are reached. They're used by a single
+	// HTTPFetcher per source, which is reused for every fetch.
+	Transport *HTTPTransport `json:",omitempty"`
+	Session   *HTTPSession   `json:",omitempty"`
+
+	// Accept, UserAgent, BasicAuth, BearerToken, Headers, Method and Body customize the requests to http:// and
+	// https:// sources, see HTTPFetchOption. Headers are set last, such that they override the others. Method defaults
+	// to POST if a Body is given, and to GET otherwise.
+	Accept      string            `json:",omitempty"`
+	UserAgent   string            `json:",omitempty"`
+	BasicAuth   *BasicAuth        `json:",omitempty"`
+	BearerToken *Secret           `json:",omitempty"`
+	Headers     map[string]string `json:",omitempty"`
+	Method      string            `json:",omitempty"`
+	Body        *HTTPBody         `json:",omitempty"`
+	// Pagination, if given, follows the pages of an http:// or https:// source and stores them as one snapshot.
+	Pagination *Pagination `json:",omitempty"`
+}
+
+type BasicAuth struct {
+	User string
+	Pass string
+}
+
+// Secret refers to a value that shouldn't be in the configuration itself: either the contents of File (without
+// trailing whitespace), or the environment variable Env. It's read again every time it's used.
+type Secret struct {
+	File string `json:",omitempty"`
+	Env  string `json:",omitempty"`
+}
+
+// Read returns the value of the secret, or an error if it's unavailable or empty.
+func (s *Secret) Read() (string, error) {
+	var val string
+	switch {
+	case s.File != "":
+		b, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", err
+		}
+		val = strings.TrimRight(string(b), " \t\r\n")
+	case s.Env != "":
+		val = os.Getenv(s.Env)
+	}
+	if val == "" {
+		return "", fmt.Errorf("secret %s is empty", s)
+	}
+	return val, nil
+}
+
+// String identifies the secret, without revealing its value.
+func (s *Secret) String() string {
+	if s.File != "" {
+		return "file " + s.File
+	}
+	return "environment variable " + s.Env
+}
+
+// HTTPBody is the request body of an http:// or https:// source, e.g. a GraphQL query or a form.
+type HTTPBody struct {
+	// ContentType is e.g. "application/json" or "application/x-www-form-urlencoded".
+	ContentType string
+	// Data is sent as is. If Form is given instead, it's encoded as application/x-www-form-urlencoded.
+	Data string            `json:",omitempty"`
+	Form map[string]string `json:",omitempty"`
+}
+
+// Validate checks the HTTPBody for consistency and fills in the ContentType of a Form.
+func (b *HTTPBody) Validate() error {
+	if b.Data != "" && len(b.Form) > 0 {
+		return fmt.Errorf("body has both data and form")
+	}
+	if len(b.Form) > 0 && b.ContentType == "" {
+		b.ContentType = "application/x-www-form-urlencoded"
+	}
+	if b.ContentType == "" {
+		return fmt.Errorf("body without content type")
+	}
+	return nil
+}
+
+func (b *HTTPBody) bytes() []byte {
+	if len(b.Form) > 0 {
+		form := url.Values{}
+		for k, v := range b.Form {
+			form.Set(k, v)
+		}
+		return []byte(form.Encode())
+	}
+	return []byte(b.Data)
+}
+
+// HTTPFetchOptions returns the HTTPFetchOptions that apply to every request for this source.
+func (s *Source) HTTPFetchOptions() []HTTPFetchOption {
+	ret := make([]HTTPFetchOption, 0, 6+len(s.Headers))
+	if s.Accept != "" {
+		ret = append(ret, WithAcceptHeader(s.Accept))
+	}
+	if s.UserAgent != "" {
+		ret = append(ret, WithUserAgent(s.UserAgent))
+	}
+	if s.BasicAuth != nil {
+		ret = append(ret, WithBasicAuth(s.BasicAuth.User, s.BasicAuth.Pass))
+	}
+	if s.BearerToken != nil {
+		ret = append(ret, WithBearerToken(s.BearerToken.Read))
+	}
+	if s.Method != "" {
+		ret = append(ret, WithMethod(s.Method))
+	}
+	if s.Body != nil {
+		ret = append(ret, WithBody(s.Body.ContentType, s.Body.bytes()))
+	}
+	for name, val := range s.Headers {
+		ret = append(ret, WithHeader(name, val))
+	}
+	return ret
+}
+
+// vim: cc=120:
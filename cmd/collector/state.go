@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mrngm/apploos/util"
+)
+
+const StateFileName = "collector-state.json"
+
+// SourceState is what the collector remembers about a source in between fetches, and across restarts.
+type SourceState struct {
+	// ETag and LastModified are the validators of the most recently stored response. They are sent along with the
+	// next request, such that an unchanged source can answer with 304 Not Modified.
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+
+	// Checksum is the checksum of the most recent snapshot. LastChanged is the moment the source last changed into
+	// that snapshot, LastSeen the moment the source was last confirmed to be unchanged (or changed).
+	Checksum    string    `json:",omitempty"`
+	LastChanged time.Time `json:",omitempty"`
+	LastSeen    time.Time `json:",omitempty"`
+
+	// NotBefore is the moment before which the source asked not to be fetched again, through Retry-After or (see
+	// PollPolicy.UseMaxAge) max-age.
+	NotBefore time.Time `json:",omitempty"`
+}
+
+// StateStore keeps the SourceState of every source in a single JSON file alongside the stored blobs. It's safe for use
+// by multiple goroutines.
+type StateStore struct {
+	mu      sync.Mutex
+	dir     string
+	sources map[string]SourceState
+}
+
+// LoadStateStore reads the StateStore from dir. A missing state file results in an empty StateStore, and nil error.
+func LoadStateStore(dir string) (*StateStore, error) {
+	ss := &StateStore{
+		dir:     dir,
+		sources: make(map[string]SourceState),
+	}
+	contents, err := os.ReadFile(filepath.Join(dir, StateFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info("no collector state found, starting afresh", "dir", dir)
+		return ss, nil
+	} else if err != nil {
+		slog.Error("cannot read collector state", "err", err, "dir", dir)
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &ss.sources); err != nil {
+		slog.Error("cannot unmarshal collector state", "err", err, "dir", dir)
+		return nil, err
+	}
+	return ss, nil
+}
+
+// Get returns the SourceState for key, or the zero SourceState if it's unknown.
+func (ss *StateStore) Get(key string) SourceState {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.sources[key]
+}
+
+// Checksums returns the checksums of the most recent snapshots of all sources.
+func (ss *StateStore) Checksums() map[string]struct{} {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ret := make(map[string]struct{}, len(ss.sources))
+	for _, st := range ss.sources {
+		if st.Checksum != "" {
+			ret[st.Checksum] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// Update calls fn with the SourceState for key and persists the result to disk. The in-memory state is updated even if
+// persisting fails.
+func (ss *StateStore) Update(ctx context.Context, key string, fn func(*SourceState)) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	st := ss.sources[key]
+	fn(&st)
+	ss.sources[key] = st
+	return ss.save(ctx)
+}
+
+// Save persists the state of all sources to disk.
+func (ss *StateStore) Save(ctx context.Context) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.save(ctx)
+}
+
+func (ss *StateStore) save(ctx context.Context) error {
+	contents, err := json.MarshalIndent(ss.sources, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = util.SaveToDisk(ctx, ss.dir, StateFileName, contents, true, true)
+	return err
+}
+
+// vim: cc=120:
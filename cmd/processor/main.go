@@ -22,9 +22,12 @@ var (
 	prod       = flag.Bool("prod", false, "When given, don't show the TESTING banner")
 	storage    = flag.String("storage", "", "Scan this directory for collecting Vierdaagse JSON files")
 	pattern    = flag.String("pattern", "*.blob", "Only consider these files to be actual data files, see path.Match")
+	archive    = flag.String("archive", "", "Read the most recent Vierdaagse JSON snapshot (of -source, if given) from this tar archive, as exported by the collector")
+	source     = flag.String("source", "", "Only consider snapshots of this source (name or URL) in -storage, according to the metadata written by the collector. When empty, all snapshots are considered")
 	out        = flag.String("out", "-", "Write to this file, or - for standard output")
 	outDir     = flag.String("outDir", "", "Write to this directory, or use current working directory. This automatically writes the stylesheet as style.css.")
 	cleanupTmp = flag.Bool("cleanTmp", false, "Cleanup temporary files after either a successful or unsuccessful write")
+	lockWait   = flag.Duration("lockWait", time.Minute, "Wait this long for the collector to finish deleting snapshots in -storage before reading, see util.SnapshotLockName. Fails right away when 0, waits indefinitely when < 0")
 )
 
 func readJsonFile(fn string) (VierdaagseOverview, error) {
@@ -43,6 +46,28 @@ func readJsonFile(fn string) (VierdaagseOverview, error) {
 	return ret, nil
 }
 
+// readJsonSnapshot reads the most recent snapshot of *source (or of any source) in store.
+func readJsonSnapshot(store util.Store) (VierdaagseOverview, util.SnapshotMeta, error) {
+	ret := VierdaagseOverview{}
+	meta, err := store.Latest(context.TODO(), *source)
+	if err != nil {
+		slog.Error("cannot find snapshot", "err", err, "source", *source)
+		return ret, meta, err
+	}
+	rc, meta, err := store.Get(context.TODO(), meta.Source, meta.Checksum)
+	if err != nil {
+		slog.Error("cannot read snapshot", "err", err, "source", meta.Source, "checksum", meta.Checksum)
+		return ret, meta, err
+	}
+	defer rc.Close()
+
+	if err := json.NewDecoder(rc).Decode(&ret); err != nil {
+		slog.Error("cannot unmarshal JSON", "err", err, "source", meta.Source, "checksum", meta.Checksum)
+		return ret, meta, err
+	}
+	return ret, meta, nil
+}
+
 func readICalFile(fn string) (ICalendar, error) {
 	calendar := ICalendar{}
 	icalContents, err := os.ReadFile(fn)
@@ -77,6 +102,10 @@ func readICalFile(fn string) (ICalendar, error) {
 	return calendar, nil
 }
 
+// readStorageDir selects the most recent snapshot in *storage that matches *pattern (and *source, if given). Snapshots
+// are ordered by the fetch time in their metadata (see util.SnapshotMeta), or by modification time if a snapshot has no
+// metadata. It returns the modification time of *storage, the fetch (or modification) time of the selected snapshot,
+// and its filename.
 func readStorageDir() (dirModTime time.Time, fileModTime time.Time, recentFile string, err error) {
 	dirStat, err := os.Stat(*storage)
 	if err != nil {
@@ -108,30 +137,58 @@ func readStorageDir() (dirModTime time.Time, fileModTime time.Time, recentFile s
 		return time.Time{}, time.Time{}, "", fmt.Errorf("no matches")
 	}
 
-	slices.SortFunc(patternMatched, func(a, b os.DirEntry) int {
-		infoA, errA := a.Info()
-		infoB, errB := b.Info()
-		if errA != nil || errB != nil {
-			slog.Debug("sorting direntry failed", "errA", errA, "errB", errB, "entryA", a, "entryB", b)
-			return 0
+	// Prefer the fetch time from the snapshot metadata written by the collector over the file modification time
+	metas, err := util.NewFSStore(*storage, *cleanupTmp).List(context.TODO(), "")
+	if err != nil {
+		slog.Error("could not read snapshot metadata, relying on modification times", "err", err, "dir", *storage)
+	}
+	metaByBlob := make(map[string]util.SnapshotMeta)
+	for _, meta := range metas {
+		if *source != "" && meta.Source != *source && meta.URL != *source {
+			continue
 		}
-		return infoA.ModTime().Compare(infoB.ModTime())
-	})
+		metaByBlob[meta.BlobName()] = meta
+	}
 
-	lastMatch := patternMatched[len(patternMatched)-1]
-	fnInfo, err := lastMatch.Info()
-	if err != nil {
-		slog.Error("could not request information from last match", "err", err, "lastMatch", lastMatch)
-		return time.Time{}, time.Time{}, "", fmt.Errorf("internal error")
+	type snapshot struct {
+		name      string
+		fetchTime time.Time
+	}
+	snapshots := make([]snapshot, 0, len(patternMatched))
+	for _, entry := range patternMatched {
+		if meta, ok := metaByBlob[entry.Name()]; ok {
+			snapshots = append(snapshots, snapshot{name: entry.Name(), fetchTime: meta.FetchEnd})
+			continue
+		}
+		if *source != "" {
+			// Without metadata, we cannot tell whether this file belongs to the requested source
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			slog.Debug("requesting direntry information failed, skipping", "err", err, "entry", entry)
+			continue
+		}
+		snapshots = append(snapshots, snapshot{name: entry.Name(), fetchTime: info.ModTime()})
+	}
+	if len(snapshots) == 0 {
+		slog.Info("no snapshots found", "dir", *storage, "pattern", *pattern, "source", *source)
+		return time.Time{}, time.Time{}, "", fmt.Errorf("no matches")
 	}
-	return dirStat.ModTime(), fnInfo.ModTime(), filepath.Join(*storage, lastMatch.Name()), nil
+
+	slices.SortFunc(snapshots, func(a, b snapshot) int {
+		return a.fetchTime.Compare(b.fetchTime)
+	})
+
+	lastMatch := snapshots[len(snapshots)-1]
+	return dirStat.ModTime(), lastMatch.fetchTime, filepath.Join(*storage, lastMatch.name), nil
 }
 
 func main() {
 	flag.Parse()
 
-	if len(*jsonFile) > 0 && len(*storage) > 0 {
-		slog.Error("Please provide either -json or -storage")
+	if len(*jsonFile) > 0 && len(*storage) > 0 || len(*archive) > 0 && (len(*jsonFile) > 0 || len(*storage) > 0) {
+		slog.Error("Please provide either -json, -storage or -archive")
 		os.Exit(1)
 	}
 
@@ -152,6 +209,17 @@ func main() {
 		}
 		everything = try
 	} else if len(*storage) > 0 && len(*pattern) > 0 {
+		// Keep the collector from deleting the snapshot while it's selected and read
+		lockCtx, cancelLock := context.WithCancel(context.TODO())
+		if *lockWait > 0 {
+			lockCtx, cancelLock = context.WithTimeout(context.TODO(), *lockWait)
+		}
+		lock, err := util.NewFSStore(*storage, *cleanupTmp).LockShared(lockCtx, *lockWait != 0)
+		cancelLock()
+		if err != nil {
+			slog.Error("could not lock storage dir", "err", err, "dir", *storage)
+			os.Exit(1)
+		}
 		// Automatically read *storage, only looking for files matching *pattern, returning the *storage modification
 		// time, the most recent filename, and errors should they occur
 		dirModTime, fileModTime, fn, err := readStorageDir()
@@ -163,9 +231,23 @@ func main() {
 		if err != nil {
 			os.Exit(1)
 		}
+		if err := lock.Release(); err != nil {
+			slog.Error("could not release storage dir lock", "err", err, "dir", *storage)
+		}
 		try.DirModTime = dirModTime
 		try.FileModTime = fileModTime
 		everything = try
+	} else if len(*archive) > 0 {
+		try, meta, err := readJsonSnapshot(util.NewTarStore(*archive, *cleanupTmp))
+		if err != nil {
+			os.Exit(1)
+		}
+		slog.Info("Read archive", "archive", *archive, "source", meta.Source, "checksum", meta.Checksum, "fetchEnd", meta.FetchEnd)
+		try.FileModTime = meta.FetchEnd
+		if info, err := os.Stat(*archive); err == nil {
+			try.DirModTime = info.ModTime()
+		}
+		everything = try
 	}
 
 	if len(*icalFile) > 0 {
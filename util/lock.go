@@ -0,0 +1,128 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// InstanceLockName is the lock file a collector holds exclusively in its storage directory for as long as it runs,
+	// such that a single collector writes into a storage directory at a time.
+	InstanceLockName = ".collector.lock"
+	// SnapshotLockName is the lock file that guards the snapshots in a directory of an FSStore. Readers that need a
+	// consistent view, e.g. the processor, hold it shared, while FSStore.Delete holds it exclusively. Adding snapshots
+	// doesn't need it, as blobs and sidecars are written atomically, and blobs without sidecar are ignored.
+	SnapshotLockName = ".snapshots.lock"
+)
+
+// lockPollInterval is how often a lock that is held by another process is tried again, when waiting for it.
+const lockPollInterval = 250 * time.Millisecond
+
+// LockedError is returned when a lock is held by another process. PID is that process, if it's known: exclusive
+// holders record their PID in the lock file, shared holders don't.
+type LockedError struct {
+	Path string
+	PID  int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("%s is locked by pid %d", e.Path, e.PID)
+	}
+	return fmt.Sprintf("%s is locked by another process", e.Path)
+}
+
+// Lock is an advisory lock (flock) on a lock file, see AcquireLock. It's released when the process exits at the latest.
+type Lock struct {
+	f         *os.File
+	exclusive bool
+}
+
+// AcquireLock takes an advisory lock on the file at path, which is created if needed: an exclusive one, or a shared one
+// that other processes may hold as well. If another process holds a conflicting lock, AcquireLock returns a
+// *LockedError right away, or waits until the lock is released if wait is given. Waiting stops with an error wrapping a
+// *LockedError when ctx is done.
+//
+// An exclusive lock records the PID of this process in the lock file, such that others can tell who holds it.
+func AcquireLock(ctx context.Context, path string, exclusive bool, wait bool) (*Lock, error) {
+	// A shared lock only needs to read the lock file, such that readers without write permission can take it
+	flags, how := os.O_RDONLY, syscall.LOCK_SH
+	if exclusive {
+		flags, how = os.O_RDWR, syscall.LOCK_EX
+	}
+	f, err := os.OpenFile(path, flags|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open lock file: %v", err)
+	}
+
+	var ticker *time.Ticker
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("cannot lock %s: %v", path, err)
+		}
+		locked := &LockedError{Path: path, PID: lockHolder(f)}
+		if !wait {
+			f.Close()
+			return nil, locked
+		}
+		if ticker == nil {
+			slog.Info("waiting for lock", "fn", path, "pid", locked.PID, "exclusive", exclusive)
+			ticker = time.NewTicker(lockPollInterval)
+			defer ticker.Stop()
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("%w, gave up waiting: %v", locked, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	if exclusive {
+		if err := f.Truncate(0); err != nil {
+			slog.Error("cannot clear lock file", "err", err, "fn", path)
+		} else if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+			slog.Error("cannot record pid in lock file", "err", err, "fn", path)
+		}
+	}
+	return &Lock{f: f, exclusive: exclusive}, nil
+}
+
+// lockHolder returns the PID recorded in the lock file f, or 0 if there is none, or if that process is gone (e.g. an
+// exclusive holder crashed, and the lock is held shared now).
+func lockHolder(f *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return 0
+	}
+	return pid
+}
+
+// Release releases the lock. An exclusive lock clears the PID it recorded first.
+func (l *Lock) Release() error {
+	if l.exclusive {
+		if err := l.f.Truncate(0); err != nil {
+			slog.Error("cannot clear lock file", "err", err, "fn", l.f.Name())
+		}
+	}
+	return l.f.Close()
+}
+
+// vim: cc=120:
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	// Locks of separately opened lock files conflict, even within a single process
+	tests := []struct {
+		name string
+		// first and second tell whether the locks are exclusive
+		first, second bool
+		conflicts     bool
+		// wantPID is the holder that is reported when the locks conflict
+		wantPID int
+	}{
+		{"exclusive, exclusive", true, true, true, os.Getpid()},
+		{"exclusive, shared", true, false, true, os.Getpid()},
+		{"shared, exclusive", false, true, true, 0},
+		{"shared, shared", false, false, false, 0},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), InstanceLockName)
+		first, err := AcquireLock(ctx, path, test.first, false)
+		if err != nil {
+			t.Errorf("%s: first lock failed: %v", test.name, err)
+			continue
+		}
+		second, err := AcquireLock(ctx, path, test.second, false)
+		if !test.conflicts {
+			if err != nil {
+				t.Errorf("%s: second lock failed: %v", test.name, err)
+			} else {
+				second.Release()
+			}
+			first.Release()
+			continue
+		}
+
+		var locked *LockedError
+		if !errors.As(err, &locked) {
+			t.Errorf("%s: second lock returned %v, want a LockedError", test.name, err)
+			first.Release()
+			continue
+		}
+		if locked.PID != test.wantPID {
+			t.Errorf("%s: locked by pid %d, want %d", test.name, locked.PID, test.wantPID)
+		}
+
+		// Once released, the lock can be taken
+		if err := first.Release(); err != nil {
+			t.Errorf("%s: releasing failed: %v", test.name, err)
+		}
+		second, err = AcquireLock(ctx, path, test.second, false)
+		if err != nil {
+			t.Errorf("%s: lock after release failed: %v", test.name, err)
+			continue
+		}
+		second.Release()
+	}
+}
+
+func TestAcquireLockRecordsPID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), InstanceLockName)
+	lock, err := AcquireLock(context.Background(), path, true, false)
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(contents)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("lock file holds %q, %v, want pid %d", contents, err, os.Getpid())
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("releasing failed: %v", err)
+	}
+	if contents, err := os.ReadFile(path); err != nil || len(contents) != 0 {
+		t.Errorf("released lock file holds %q, %v, want it empty", contents, err)
+	}
+
+	// A PID of a process that is gone isn't reported
+	if err := os.WriteFile(path, []byte("999999999\n"), 0644); err != nil {
+		t.Fatalf("writing lock file failed: %v", err)
+	}
+	shared, err := AcquireLock(context.Background(), path, false, false)
+	if err != nil {
+		t.Fatalf("shared lock failed: %v", err)
+	}
+	defer shared.Release()
+	var locked *LockedError
+	if _, err := AcquireLock(context.Background(), path, true, false); !errors.As(err, &locked) || locked.PID != 0 {
+		t.Errorf("exclusive lock returned %v, want a LockedError without pid", err)
+	}
+}
+
+func TestAcquireLockWait(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SnapshotLockName)
+	first, err := AcquireLock(context.Background(), path, true, false)
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+
+	// Waiting gives up when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 2*lockPollInterval)
+	defer cancel()
+	var locked *LockedError
+	if _, err := AcquireLock(ctx, path, false, true); !errors.As(err, &locked) || ctx.Err() == nil {
+		t.Errorf("waiting returned %v, want a LockedError after the context is done", err)
+	}
+
+	// Waiting succeeds once the lock is released
+	go func() {
+		time.Sleep(lockPollInterval)
+		first.Release()
+	}()
+	start := time.Now()
+	second, err := AcquireLock(context.Background(), path, false, true)
+	if err != nil {
+		t.Fatalf("waiting failed: %v", err)
+	}
+	second.Release()
+	if waited := time.Since(start); waited < lockPollInterval/2 {
+		t.Errorf("lock was taken after %v, before it was released", waited)
+	}
+}
+
+// vim: cc=120:
@@ -0,0 +1,140 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// BlobExt is the extension of stored snapshots, which are named after their checksum.
+	BlobExt = ".blob"
+	// SnapshotMetaExt is the extension of the sidecar that describes the snapshot of a source, see
+	// SnapshotMeta.MetaName.
+	SnapshotMetaExt = ".meta.json"
+)
+
+// SnapshotMeta describes where and when a snapshot (a stored blob) came from. The collector writes it as a JSON
+// sidecar next to every blob, such that a snapshot can be selected by source and fetch time rather than file
+// modification time.
+type SnapshotMeta struct {
+	// Source is the name of the source, URL is where it was fetched from.
+	Source string
+	URL    string
+	// Checksum is the hex encoded sha256 of the blob, Size is its length in bytes.
+	Checksum string
+	Size     int64
+	// FetchStart is the moment the fetch started, FetchEnd the moment the blob was completely written.
+	FetchStart time.Time
+	FetchEnd   time.Time
+	// RequestId, StatusCode, Status and Header describe the response, if the protocol has such a notion. Header values
+	// that carry credentials, such as Set-Cookie, are redacted.
+	RequestId  string      `json:",omitempty"`
+	StatusCode int         `json:",omitempty"`
+	Status     string      `json:",omitempty"`
+	Header     http.Header `json:",omitempty"`
+	// Timings break down the duration of the request, if the protocol is HTTP.
+	Timings *HTTPTimings `json:",omitempty"`
+}
+
+// HTTPTimings is the breakdown of the duration of an HTTP request, in nanoseconds in JSON. Phases that didn't happen,
+// e.g. DNS and Connect for a reused connection, are 0. A request that is redirected or repeated accumulates the phases
+// of all its round trips.
+type HTTPTimings struct {
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// TTFB (time to first byte) runs from the start of the request until the first byte of the (last) response.
+	TTFB time.Duration
+	// Total runs from the start of the request until the response body was read or closed.
+	Total time.Duration
+}
+
+// Add adds the phases of other to t, e.g. to sum the requests of a source that spans multiple pages.
+func (t *HTTPTimings) Add(other HTTPTimings) {
+	t.DNS += other.DNS
+	t.Connect += other.Connect
+	t.TLSHandshake += other.TLSHandshake
+	t.TTFB += other.TTFB
+	t.Total += other.Total
+}
+
+func (t HTTPTimings) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Duration("dns", t.DNS),
+		slog.Duration("connect", t.Connect),
+		slog.Duration("tls", t.TLSHandshake),
+		slog.Duration("ttfb", t.TTFB),
+		slog.Duration("total", t.Total),
+	)
+}
+
+// BlobName returns the filename of the blob described by meta.
+func (meta SnapshotMeta) BlobName() string {
+	return meta.Checksum + BlobExt
+}
+
+// MetaName returns the filename of the sidecar of meta: the checksum followed by the escaped source. Sources that
+// store the same contents share the blob, but each has its own sidecar. Sidecars of snapshots without source, and those
+// written before sidecars were kept per source, are named after the checksum only.
+func (meta SnapshotMeta) MetaName() string {
+	if meta.Source == "" {
+		return meta.Checksum + SnapshotMetaExt
+	}
+	return meta.Checksum + "." + url.PathEscape(meta.Source) + SnapshotMetaExt
+}
+
+// SaveSnapshotMeta writes meta as a sidecar in dir, next to the blob it describes. An existing sidecar for the same
+// source and checksum is replaced.
+func SaveSnapshotMeta(ctx context.Context, dir string, meta SnapshotMeta) error {
+	contents, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = SaveToDisk(ctx, dir, meta.MetaName(), contents, true, true)
+	return err
+}
+
+// ReadSnapshotMeta reads the sidecar at path.
+func ReadSnapshotMeta(path string) (SnapshotMeta, error) {
+	meta := SnapshotMeta{}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(contents, &meta); err != nil {
+		return meta, fmt.Errorf("cannot unmarshal metadata in %q: %v", path, err)
+	}
+	return meta, nil
+}
+
+// ReadSnapshotMetas reads all sidecars in dir. Sidecars that cannot be read or parsed are logged and skipped.
+func ReadSnapshotMetas(dir string) ([]SnapshotMeta, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("could not read snapshot dir", "err", err, "dir", dir)
+		return nil, err
+	}
+	ret := make([]SnapshotMeta, 0, len(entries)/2)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), SnapshotMetaExt) {
+			continue
+		}
+		meta, err := ReadSnapshotMeta(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			slog.Error("could not read snapshot metadata, skipping", "err", err, "dir", dir, "fn", entry.Name())
+			continue
+		}
+		ret = append(ret, meta)
+	}
+	return ret, nil
+}
+
+// vim: cc=120:
@@ -2,12 +2,108 @@ package util
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 )
 
+var (
+	// ErrMaxSizeExceeded is returned by SaveStreamToDisk when the stream holds more bytes than allowed.
+	ErrMaxSizeExceeded = errors.New("maximum size exceeded")
+	// ErrDestinationExists is returned when overwriting isn't allowed and the destination already exists. For
+	// SaveStreamToDisk, this means the exact same contents are stored already.
+	ErrDestinationExists = errors.New("destination already exists")
+	// ErrSnapshotNotFound is returned by a Store for a snapshot it doesn't have.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+// Store keeps snapshots: blobs together with their SnapshotMeta, keyed by source and checksum (the hex encoded sha256
+// of the blob). See FSStore, MemStore and TarStore. Implementations are safe for use by multiple goroutines.
+type Store interface {
+	// Put stores the contents of r as a snapshot of meta.Source, and returns meta with Checksum and Size filled in, as
+	// well as FetchEnd if it's zero (the moment r was read completely). At most maxSize bytes are accepted, or an
+	// unlimited amount if maxSize <= 0. Larger contents result in an error wrapping ErrMaxSizeExceeded. If the source
+	// has a snapshot with the same checksum already, it's left untouched, and an error wrapping ErrDestinationExists is
+	// returned together with the completed meta.
+	Put(ctx context.Context, meta SnapshotMeta, r io.Reader, maxSize int64) (SnapshotMeta, error)
+	// PutMeta replaces the metadata of an existing snapshot, e.g. to make it the latest one again.
+	PutMeta(ctx context.Context, meta SnapshotMeta) error
+	// Get returns the contents and metadata of a snapshot. The caller should close the contents.
+	Get(ctx context.Context, source string, checksum string) (io.ReadCloser, SnapshotMeta, error)
+	// List returns the metadata of all snapshots of source, or of all sources if source is empty, ordered by FetchEnd
+	// (oldest first).
+	List(ctx context.Context, source string) ([]SnapshotMeta, error)
+	// Latest returns the metadata of the most recent snapshot of source, or of all sources if source is empty.
+	Latest(ctx context.Context, source string) (SnapshotMeta, error)
+	// Delete removes a snapshot. Removing a snapshot that doesn't exist isn't an error.
+	Delete(ctx context.Context, source string, checksum string) error
+}
+
+// sortSnapshotMetas orders metas by FetchEnd, oldest first.
+func sortSnapshotMetas(metas []SnapshotMeta) {
+	slices.SortFunc(metas, func(a, b SnapshotMeta) int {
+		return a.FetchEnd.Compare(b.FetchEnd)
+	})
+}
+
+// latestSnapshotMeta implements Store.Latest on top of Store.List.
+func latestSnapshotMeta(ctx context.Context, s Store, source string) (SnapshotMeta, error) {
+	metas, err := s.List(ctx, source)
+	if err != nil {
+		return SnapshotMeta{}, err
+	}
+	if len(metas) == 0 {
+		return SnapshotMeta{}, fmt.Errorf("no snapshots of source %q: %w", source, ErrSnapshotNotFound)
+	}
+	return metas[len(metas)-1], nil
+}
+
+// ReadAtMost reads r into memory, refusing more than maxSize bytes (or an unlimited amount if maxSize <= 0) with an
+// error wrapping ErrMaxSizeExceeded.
+func ReadAtMost(r io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("stream holds more than %d bytes: %w", maxSize, ErrMaxSizeExceeded)
+	}
+	return data, nil
+}
+
+// CopySnapshots copies the snapshots of source, or of all sources if source is empty, from src to dst. Snapshots that
+// dst has already are skipped. It returns the number of copied snapshots.
+func CopySnapshots(ctx context.Context, dst Store, src Store, source string) (int, error) {
+	metas, err := src.List(ctx, source)
+	if err != nil {
+		return 0, err
+	}
+	copied := 0
+	for _, meta := range metas {
+		rc, _, err := src.Get(ctx, meta.Source, meta.Checksum)
+		if err != nil {
+			return copied, err
+		}
+		_, err = dst.Put(ctx, meta, rc, 0)
+		rc.Close()
+		if errors.Is(err, ErrDestinationExists) {
+			continue
+		} else if err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	return copied, nil
+}
+
 // SaveToDisk writes the data to a temporary file in saveDir and syncs to disk for crash safety. After that, it tries
 // to move the file into place with the supplied name and syncs the saveDir directory such that the metadata is
 // persisted as well.
@@ -20,14 +116,58 @@ import (
 //
 // Temporary files are chmodded to 0644 by default.
 func SaveToDisk(ctx context.Context, saveDir string, name string, data []byte, cleanupTmp bool, allowOverwrite bool) (int, error) {
-	fp := filepath.Join(saveDir, name)
-	slog.Debug("SaveToDisk", "fn", name, "dataLen", len(data), "dir", saveDir, "fullPath", fp)
+	slog.Debug("SaveToDisk", "fn", name, "dataLen", len(data), "dir", saveDir, "fullPath", filepath.Join(saveDir, name))
 
+	write := func(w io.Writer) (int64, error) {
+		n, err := w.Write(data)
+		return int64(n), err
+	}
+	nameFn := func() string {
+		return name
+	}
+	_, n, err := saveAtomically(ctx, saveDir, "tmp-"+name+"-", write, nameFn, cleanupTmp, allowOverwrite, false)
+	return int(n), err
+}
+
+// SaveStreamToDisk is the streaming counterpart of SaveToDisk, for data of which the name isn't known up front. It
+// copies r into a temporary file in saveDir in a single pass, while feeding the same bytes to h. Once r is exhausted,
+// the temporary file is moved into place, named after the hex encoded sum of h followed by ext (e.g. ".blob"). The
+// name is returned, together with the number of bytes written.
+//
+// At most maxSize bytes are accepted, or an unlimited amount if maxSize <= 0. Larger streams result in an error
+// wrapping ErrMaxSizeExceeded. If allowOverwrite is false and a file with the resulting name exists already, an error
+// wrapping ErrDestinationExists is returned, together with the name. In both cases, the temporary file is useless and
+// removed regardless of cleanupTmp. Otherwise, cleanupTmp and allowOverwrite behave like they do for SaveToDisk.
+func SaveStreamToDisk(ctx context.Context, saveDir string, r io.Reader, maxSize int64, h hash.Hash, ext string, cleanupTmp bool, allowOverwrite bool) (string, int64, error) {
+	slog.Debug("SaveStreamToDisk", "dir", saveDir, "maxSize", maxSize, "ext", ext)
+
+	write := func(w io.Writer) (int64, error) {
+		src := r
+		if maxSize > 0 {
+			// Read one byte more than allowed, such that we can tell the stream was too large
+			src = io.LimitReader(r, maxSize+1)
+		}
+		n, err := io.Copy(io.MultiWriter(w, h), src)
+		if err == nil && maxSize > 0 && n > maxSize {
+			return n, fmt.Errorf("stream holds more than %d bytes: %w", maxSize, ErrMaxSizeExceeded)
+		}
+		return n, err
+	}
+	nameFn := func() string {
+		return fmt.Sprintf("%x%s", h.Sum(nil), ext)
+	}
+	return saveAtomically(ctx, saveDir, "tmp-stream-", write, nameFn, cleanupTmp, allowOverwrite, true)
+}
+
+// saveAtomically implements SaveToDisk and SaveStreamToDisk. It calls write with a temporary file in saveDir, syncs it,
+// and renames it to the name returned by nameFn, which is only called after write succeeded. If contentAddressed is
+// given, an existing destination holds the same contents as the temporary file, which is then removed.
+func saveAtomically(ctx context.Context, saveDir string, patternTmp string, write func(io.Writer) (int64, error), nameFn func() string, cleanupTmp bool, allowOverwrite bool, contentAddressed bool) (string, int64, error) {
 	// Already open a file descriptor to the directory such that we can sync metadata as well.
 	dirFn, err := os.Open(saveDir)
 	if err != nil {
 		slog.Error("SaveToDisk(dirFn.Open) failed", "err", err)
-		return 0, err
+		return "", 0, err
 	}
 	defer func() {
 		if err := dirFn.Close(); err != nil {
@@ -35,11 +175,10 @@ func SaveToDisk(ctx context.Context, saveDir string, name string, data []byte, c
 		}
 	}()
 
-	patternTmp := "tmp-" + name + "-"
 	fnTmp, err := os.CreateTemp(saveDir, patternTmp)
 	if err != nil {
 		slog.Error("SaveToDisk(CreateTemp)", "dir", saveDir, "pattern", patternTmp, "err", err)
-		return 0, err
+		return "", 0, err
 	}
 	shouldCloseTmpFile := true
 	defer func() {
@@ -50,8 +189,9 @@ func SaveToDisk(ctx context.Context, saveDir string, name string, data []byte, c
 		}
 	}()
 	tmpFileInPlace := true
+	tmpFileUseless := false
 	defer func() {
-		if cleanupTmp && tmpFileInPlace {
+		if (cleanupTmp || tmpFileUseless) && tmpFileInPlace {
 			if err := os.Remove(fnTmp.Name()); err != nil {
 				slog.Error("(deferred) cleanup of fnTmp failed", "err", err, "dir", saveDir, "fnTmp", fnTmp.Name())
 			}
@@ -62,27 +202,41 @@ func SaveToDisk(ctx context.Context, saveDir string, name string, data []byte, c
 		slog.Error("SaveToDisk(fnTmp.Chmod) failed to change to 0644", "err", err, "dir", saveDir, "fnTmp", fnTmp.Name())
 	}
 
-	n, err := fnTmp.Write(data)
+	n, err := write(fnTmp)
 	if err != nil {
 		slog.Error("SaveToDisk(fnTmp.Write) failed", "err", err, "bytes_written", n, "dir", saveDir, "fnTmp", fnTmp.Name())
-		return n, err
+		tmpFileUseless = errors.Is(err, ErrMaxSizeExceeded)
+		return "", n, err
+	}
+
+	name := nameFn()
+	fp := filepath.Join(saveDir, name)
+	if contentAddressed && !allowOverwrite {
+		// The name follows from the contents, so an existing destination holds the exact same data. There's no need to
+		// sync and move the temporary file.
+		if _, err := os.Stat(fp); err == nil {
+			slog.Debug("SaveStreamToDisk destination file already exists, removing duplicate tmpfile", "fn", fp, "dir", saveDir, "tmpFn", fnTmp.Name(), "bytes_written", n)
+			tmpFileUseless = true
+			return name, n, fmt.Errorf("destination file %q: %w", fp, ErrDestinationExists)
+		}
 	}
+
 	// Sync tmpfile
 	if err := fnTmp.Sync(); err != nil {
 		slog.Error("SaveToDisk(fnTmp.Sync) failed", "err", err, "bytes_written", n, "dir", saveDir, "fnTmp", fnTmp.Name())
-		return n, err
+		return "", n, err
 	}
 
 	// Sync directory of tmpfile
 	if err := dirFn.Sync(); err != nil {
 		slog.Error("SaveToDisk(fnTmp/dirFn.Sync) failed", "err", err, "bytes_written", n, "dir", saveDir)
-		return n, err
+		return "", n, err
 	}
 
 	if err := fnTmp.Close(); err != nil {
 		slog.Error("SaveToDisk(fnTmp.Close) failed", "err", err, "bytes_written", n, "dir", saveDir, "fnTmp", fnTmp.Name())
 		shouldCloseTmpFile = false
-		return n, err
+		return "", n, err
 	}
 	shouldCloseTmpFile = false
 
@@ -95,26 +249,26 @@ func SaveToDisk(ctx context.Context, saveDir string, name string, data []byte, c
 			closeErr := tryDest.Close()
 			slog.Error("SaveToDisk failed, destination file already exists, leaving tmpfile", "fn", fp, "closeErr", closeErr, "dir", saveDir, "tmpFn", fnTmp.Name(), "bytes_written", n)
 			if cleanupTmp {
-				return n, fmt.Errorf("destination file %q already exists, preventing write, removing tmpFile %q in saveDir %q, closeErr: %v", fp, fnTmp.Name(), saveDir, closeErr)
+				return name, n, fmt.Errorf("destination file %q already exists, preventing write, removing tmpFile %q in saveDir %q, closeErr: %v: %w", fp, fnTmp.Name(), saveDir, closeErr, ErrDestinationExists)
 			}
-			return n, fmt.Errorf("destination file %q already exists, preventing write, leaving tmpFile %q in saveDir %q, closeErr: %v", fp, fnTmp.Name(), saveDir, closeErr)
+			return name, n, fmt.Errorf("destination file %q already exists, preventing write, leaving tmpFile %q in saveDir %q, closeErr: %v: %w", fp, fnTmp.Name(), saveDir, closeErr, ErrDestinationExists)
 		}
 		// Proposed destination doesn't exist after we just synced the containing directory. Rename is likely to succeed.
 	}
 
 	if err := os.Rename(fnTmp.Name(), fp); err != nil {
 		slog.Error("SaveToDisk(rename) failed", "err", err, "bytes_written", n, "dir", saveDir, "oldpath", fnTmp.Name(), "newpath", fp)
-		return n, fmt.Errorf("could not rename %q to %q: %v", fnTmp.Name(), fp)
+		return name, n, fmt.Errorf("could not rename %q to %q: %v", fnTmp.Name(), fp, err)
 	}
 	tmpFileInPlace = false
 
 	// Sync metadata
 	if err := dirFn.Sync(); err != nil {
 		slog.Error("SaveToDisk(dirFn.Sync) failed", "err", err, "bytes_written", n, "dir", saveDir)
-		return n, err
+		return name, n, err
 	}
 
-	return n, nil
+	return name, n, nil
 }
 
 // vim: cc=120:
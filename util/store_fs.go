@@ -0,0 +1,191 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FSStore is a Store in a single directory, as written by the collector. Every snapshot is a blob named after its
+// checksum (see BlobExt), next to a sidecar with its metadata (see SnapshotMeta.MetaName). Both are written atomically,
+// see SaveToDisk. Blobs without a sidecar cannot be attributed to a source and are ignored.
+//
+// Sources may share a directory. If they store the same contents, they share the blob, but each has its own sidecar.
+type FSStore struct {
+	dir        string
+	cleanupTmp bool
+}
+
+// NewFSStore returns a FSStore in dir, which must exist. If cleanupTmp is given, temporary files are removed regardless
+// of the success of a write, see SaveToDisk.
+func NewFSStore(dir string, cleanupTmp bool) *FSStore {
+	return &FSStore{
+		dir:        dir,
+		cleanupTmp: cleanupTmp,
+	}
+}
+
+// LockShared takes the snapshot lock of the store shared (see SnapshotLockName), such that no snapshots are deleted
+// until it's released, e.g. while the latest snapshot is read. See AcquireLock for wait.
+func (s *FSStore) LockShared(ctx context.Context, wait bool) (*Lock, error) {
+	return AcquireLock(ctx, filepath.Join(s.dir, SnapshotLockName), false, wait)
+}
+
+// Dir returns the directory of the store.
+func (s *FSStore) Dir() string {
+	return s.dir
+}
+
+// readMeta reads the sidecar of the snapshot of source with checksum. A sidecar named after the checksum only (see
+// SnapshotMeta.MetaName) is used if it belongs to source.
+func (s *FSStore) readMeta(source string, checksum string) (SnapshotMeta, error) {
+	want := SnapshotMeta{Source: source, Checksum: checksum}
+	for _, fn := range []string{want.MetaName(), checksum + SnapshotMetaExt} {
+		meta, err := ReadSnapshotMeta(filepath.Join(s.dir, fn))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return meta, err
+		}
+		if meta.Source == source && meta.Checksum == checksum {
+			return meta, nil
+		}
+	}
+	return want, fmt.Errorf("no metadata of source %q for checksum %q in %q: %w", source, checksum, s.dir, ErrSnapshotNotFound)
+}
+
+// saveMeta writes the sidecar of meta, and removes the sidecar named after the checksum only if it belonged to the same
+// source.
+func (s *FSStore) saveMeta(ctx context.Context, meta SnapshotMeta) error {
+	if err := SaveSnapshotMeta(ctx, s.dir, meta); err != nil {
+		return err
+	}
+	legacy := filepath.Join(s.dir, meta.Checksum+SnapshotMetaExt)
+	if legacy == filepath.Join(s.dir, meta.MetaName()) {
+		return nil
+	}
+	if existing, err := ReadSnapshotMeta(legacy); err == nil && existing.Source == meta.Source {
+		if err := os.Remove(legacy); err != nil {
+			slog.Error("FSStore cannot remove superseded metadata", "err", err, "dir", s.dir, "fn", legacy)
+		}
+	}
+	return nil
+}
+
+func (s *FSStore) Put(ctx context.Context, meta SnapshotMeta, r io.Reader, maxSize int64) (SnapshotMeta, error) {
+	name, n, err := SaveStreamToDisk(ctx, s.dir, r, maxSize, sha256.New(), BlobExt, s.cleanupTmp, false)
+	if err != nil && !errors.Is(err, ErrDestinationExists) {
+		return meta, err
+	}
+	meta.Checksum = strings.TrimSuffix(name, BlobExt)
+	meta.Size = n
+	if meta.FetchEnd.IsZero() {
+		meta.FetchEnd = time.Now()
+	}
+	if errors.Is(err, ErrDestinationExists) {
+		if _, metaErr := s.readMeta(meta.Source, meta.Checksum); metaErr == nil {
+			return meta, err
+		}
+		// The blob belongs to another source, or its metadata got lost. Either way, it's shared with this source now.
+		slog.Debug("FSStore sharing existing blob", "dir", s.dir, "src", meta.Source, "checksum", meta.Checksum)
+	}
+	return meta, s.saveMeta(ctx, meta)
+}
+
+func (s *FSStore) PutMeta(ctx context.Context, meta SnapshotMeta) error {
+	if _, err := os.Stat(filepath.Join(s.dir, meta.BlobName())); err != nil {
+		return fmt.Errorf("no blob for checksum %q in %q: %w", meta.Checksum, s.dir, ErrSnapshotNotFound)
+	}
+	return s.saveMeta(ctx, meta)
+}
+
+func (s *FSStore) Get(ctx context.Context, source string, checksum string) (io.ReadCloser, SnapshotMeta, error) {
+	meta, err := s.readMeta(source, checksum)
+	if err != nil {
+		return nil, meta, err
+	}
+	f, err := os.Open(filepath.Join(s.dir, meta.BlobName()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, meta, fmt.Errorf("no blob for checksum %q in %q: %w", checksum, s.dir, ErrSnapshotNotFound)
+	} else if err != nil {
+		return nil, meta, err
+	}
+	return f, meta, nil
+}
+
+// List ignores sidecars of which the blob is missing.
+func (s *FSStore) List(ctx context.Context, source string) ([]SnapshotMeta, error) {
+	metas, err := ReadSnapshotMetas(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]SnapshotMeta, 0, len(metas))
+	for _, meta := range metas {
+		if source != "" && meta.Source != source {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.dir, meta.BlobName())); err != nil {
+			slog.Debug("FSStore skipping metadata without blob", "dir", s.dir, "src", meta.Source, "checksum", meta.Checksum)
+			continue
+		}
+		ret = append(ret, meta)
+	}
+	sortSnapshotMetas(ret)
+	return ret, nil
+}
+
+func (s *FSStore) Latest(ctx context.Context, source string) (SnapshotMeta, error) {
+	return latestSnapshotMeta(ctx, s, source)
+}
+
+// Delete removes the sidecar of the snapshot of source, and the blob once no other source refers to it anymore. An
+// interrupted Delete may leave a blob without sidecar behind, which is ignored, and reused by a Put of the same
+// contents. It waits for readers that hold the snapshot lock, see LockShared.
+func (s *FSStore) Delete(ctx context.Context, source string, checksum string) error {
+	lock, err := AcquireLock(ctx, filepath.Join(s.dir, SnapshotLockName), true, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			slog.Error("(deferred) releasing snapshot lock failed", "err", err, "dir", s.dir)
+		}
+	}()
+	meta, err := s.readMeta(source, checksum)
+	if errors.Is(err, ErrSnapshotNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fns := []string{meta.MetaName()}
+	if legacy := checksum + SnapshotMetaExt; legacy != meta.MetaName() {
+		if m, err := ReadSnapshotMeta(filepath.Join(s.dir, legacy)); err == nil && m.Source == source {
+			fns = append(fns, legacy)
+		}
+	}
+	for _, fn := range fns {
+		if err := os.Remove(filepath.Join(s.dir, fn)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("FSStore cannot remove snapshot metadata", "err", err, "dir", s.dir, "fn", fn)
+			return err
+		}
+	}
+	if others, err := filepath.Glob(filepath.Join(s.dir, checksum+"*"+SnapshotMetaExt)); err != nil || len(others) > 0 {
+		slog.Debug("FSStore keeping blob that other sources refer to", "dir", s.dir, "checksum", checksum, "err", err)
+		return nil
+	}
+	if err := os.Remove(filepath.Join(s.dir, meta.BlobName())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("FSStore cannot remove snapshot", "err", err, "dir", s.dir, "fn", meta.BlobName())
+		return err
+	}
+	return nil
+}
+
+// vim: cc=120:
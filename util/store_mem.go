@@ -0,0 +1,102 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// MemStore is a Store that keeps everything in memory, e.g. for tests.
+type MemStore struct {
+	mu        sync.Mutex
+	snapshots map[string]map[string]memSnapshot
+}
+
+type memSnapshot struct {
+	meta SnapshotMeta
+	data []byte
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		snapshots: make(map[string]map[string]memSnapshot),
+	}
+}
+
+func (s *MemStore) Put(ctx context.Context, meta SnapshotMeta, r io.Reader, maxSize int64) (SnapshotMeta, error) {
+	data, err := ReadAtMost(r, maxSize)
+	if err != nil {
+		return meta, err
+	}
+	meta.Checksum = fmt.Sprintf("%x", sha256.Sum256(data))
+	meta.Size = int64(len(data))
+	if meta.FetchEnd.IsZero() {
+		meta.FetchEnd = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.snapshots[meta.Source][meta.Checksum]; ok {
+		return meta, fmt.Errorf("snapshot %q of source %q: %w", meta.Checksum, meta.Source, ErrDestinationExists)
+	}
+	if s.snapshots[meta.Source] == nil {
+		s.snapshots[meta.Source] = make(map[string]memSnapshot)
+	}
+	s.snapshots[meta.Source][meta.Checksum] = memSnapshot{meta: meta, data: data}
+	return meta, nil
+}
+
+func (s *MemStore) PutMeta(ctx context.Context, meta SnapshotMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot, ok := s.snapshots[meta.Source][meta.Checksum]
+	if !ok {
+		return fmt.Errorf("snapshot %q of source %q: %w", meta.Checksum, meta.Source, ErrSnapshotNotFound)
+	}
+	snapshot.meta = meta
+	s.snapshots[meta.Source][meta.Checksum] = snapshot
+	return nil
+}
+
+func (s *MemStore) Get(ctx context.Context, source string, checksum string) (io.ReadCloser, SnapshotMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot, ok := s.snapshots[source][checksum]
+	if !ok {
+		return nil, SnapshotMeta{}, fmt.Errorf("snapshot %q of source %q: %w", checksum, source, ErrSnapshotNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(snapshot.data)), snapshot.meta, nil
+}
+
+func (s *MemStore) List(ctx context.Context, source string) ([]SnapshotMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]SnapshotMeta, 0)
+	for name, snapshots := range s.snapshots {
+		if source != "" && name != source {
+			continue
+		}
+		for _, snapshot := range snapshots {
+			ret = append(ret, snapshot.meta)
+		}
+	}
+	sortSnapshotMetas(ret)
+	return ret, nil
+}
+
+func (s *MemStore) Latest(ctx context.Context, source string) (SnapshotMeta, error) {
+	return latestSnapshotMeta(ctx, s, source)
+}
+
+func (s *MemStore) Delete(ctx context.Context, source string, checksum string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.snapshots[source], checksum)
+	return nil
+}
+
+// vim: cc=120:
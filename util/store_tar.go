@@ -0,0 +1,298 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errStopWalk stops TarStore.walk early, without an error.
+var errStopWalk = errors.New("stop walking")
+
+// TarStore is a Store in a single tar archive, e.g. for shipping snapshots around. Every snapshot consists of two
+// entries in a directory per source, named after the escaped source: the blob, named like in a FSStore (see
+// SnapshotMeta.BlobName), and its metadata, named after the checksum only (see SnapshotMetaExt). Unlike in a FSStore,
+// sources with the same contents don't share the blob. A missing archive is an empty store.
+//
+// Every modification rewrites the whole archive atomically (see SaveToDisk), so it's meant for moderate amounts of
+// snapshots. Put keeps the contents in memory.
+type TarStore struct {
+	mu         sync.Mutex
+	fn         string
+	cleanupTmp bool
+}
+
+// NewTarStore returns a TarStore in the archive fn. If cleanupTmp is given, temporary files are removed regardless of
+// the success of a write, see SaveToDisk.
+func NewTarStore(fn string, cleanupTmp bool) *TarStore {
+	return &TarStore{
+		fn:         fn,
+		cleanupTmp: cleanupTmp,
+	}
+}
+
+func tarEntryName(source string, name string) string {
+	return url.PathEscape(source) + "/" + name
+}
+
+// tarEntry is a file to add to the archive.
+type tarEntry struct {
+	name string
+	data []byte
+	meta SnapshotMeta
+}
+
+// walk calls fn for every entry in the archive, until fn returns an error. errStopWalk stops early without an error.
+func (s *TarStore) walk(fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(s.fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading archive %q failed: %v", s.fn, err)
+		}
+		if err := fn(hdr, tr); errors.Is(err, errStopWalk) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// has reports whether the archive contains an entry with the given name.
+func (s *TarStore) has(name string) (bool, error) {
+	found := false
+	err := s.walk(func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Name == name {
+			found = true
+			return errStopWalk
+		}
+		return nil
+	})
+	return found, err
+}
+
+// rewrite replaces the archive by a copy without the entries for which skip returns true, followed by add.
+func (s *TarStore) rewrite(ctx context.Context, skip func(name string) bool, add []tarEntry) error {
+	write := func(w io.Writer) (int64, error) {
+		cw := &countingWriter{w: w}
+		tw := tar.NewWriter(cw)
+		err := s.walk(func(hdr *tar.Header, r io.Reader) error {
+			if skip(hdr.Name) {
+				return nil
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		})
+		if err != nil {
+			return cw.n, err
+		}
+		for _, entry := range add {
+			hdr := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     entry.name,
+				Size:     int64(len(entry.data)),
+				Mode:     0644,
+				ModTime:  entry.meta.FetchEnd,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return cw.n, err
+			}
+			if _, err := tw.Write(entry.data); err != nil {
+				return cw.n, err
+			}
+		}
+		return cw.n, tw.Close()
+	}
+	nameFn := func() string {
+		return filepath.Base(s.fn)
+	}
+	_, _, err := saveAtomically(ctx, filepath.Dir(s.fn), "tmp-"+filepath.Base(s.fn)+"-", write, nameFn, s.cleanupTmp, true, false)
+	return err
+}
+
+func metaEntry(meta SnapshotMeta) (tarEntry, error) {
+	contents, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return tarEntry{}, err
+	}
+	return tarEntry{name: tarEntryName(meta.Source, meta.Checksum+SnapshotMetaExt), data: contents, meta: meta}, nil
+}
+
+func (s *TarStore) Put(ctx context.Context, meta SnapshotMeta, r io.Reader, maxSize int64) (SnapshotMeta, error) {
+	data, err := ReadAtMost(r, maxSize)
+	if err != nil {
+		return meta, err
+	}
+	meta.Checksum = fmt.Sprintf("%x", sha256.Sum256(data))
+	meta.Size = int64(len(data))
+	if meta.FetchEnd.IsZero() {
+		meta.FetchEnd = time.Now()
+	}
+	blobName := tarEntryName(meta.Source, meta.BlobName())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exists, err := s.has(blobName)
+	if err != nil {
+		return meta, err
+	} else if exists {
+		return meta, fmt.Errorf("entry %q in archive %q: %w", blobName, s.fn, ErrDestinationExists)
+	}
+	entry, err := metaEntry(meta)
+	if err != nil {
+		return meta, err
+	}
+	skip := func(name string) bool {
+		return name == entry.name
+	}
+	return meta, s.rewrite(ctx, skip, []tarEntry{{name: blobName, data: data, meta: meta}, entry})
+}
+
+func (s *TarStore) PutMeta(ctx context.Context, meta SnapshotMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blobName := tarEntryName(meta.Source, meta.BlobName())
+	exists, err := s.has(blobName)
+	if err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("entry %q in archive %q: %w", blobName, s.fn, ErrSnapshotNotFound)
+	}
+	entry, err := metaEntry(meta)
+	if err != nil {
+		return err
+	}
+	skip := func(name string) bool {
+		return name == entry.name
+	}
+	return s.rewrite(ctx, skip, []tarEntry{entry})
+}
+
+func (s *TarStore) Get(ctx context.Context, source string, checksum string) (io.ReadCloser, SnapshotMeta, error) {
+	blobName := tarEntryName(source, checksum+BlobExt)
+	metaName := tarEntryName(source, checksum+SnapshotMetaExt)
+	var data, metaContents []byte
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.walk(func(hdr *tar.Header, r io.Reader) error {
+		var err error
+		switch hdr.Name {
+		case blobName:
+			data, err = io.ReadAll(r)
+		case metaName:
+			metaContents, err = io.ReadAll(r)
+		}
+		if err == nil && data != nil && metaContents != nil {
+			return errStopWalk
+		}
+		return err
+	})
+	meta := SnapshotMeta{}
+	if err != nil {
+		return nil, meta, err
+	}
+	if data == nil || metaContents == nil {
+		return nil, meta, fmt.Errorf("snapshot %q of source %q in archive %q: %w", checksum, source, s.fn, ErrSnapshotNotFound)
+	}
+	if err := json.Unmarshal(metaContents, &meta); err != nil {
+		return nil, meta, fmt.Errorf("cannot unmarshal entry %q in archive %q: %v", metaName, s.fn, err)
+	}
+	return io.NopCloser(bytes.NewReader(data)), meta, nil
+}
+
+func (s *TarStore) List(ctx context.Context, source string) ([]SnapshotMeta, error) {
+	metas := make([]SnapshotMeta, 0)
+	blobs := make(map[string]struct{})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.walk(func(hdr *tar.Header, r io.Reader) error {
+		if source != "" && !strings.HasPrefix(hdr.Name, tarEntryName(source, "")) {
+			return nil
+		}
+		if strings.HasSuffix(hdr.Name, BlobExt) {
+			blobs[hdr.Name] = struct{}{}
+			return nil
+		}
+		if !strings.HasSuffix(hdr.Name, SnapshotMetaExt) {
+			return nil
+		}
+		meta := SnapshotMeta{}
+		if err := json.NewDecoder(r).Decode(&meta); err != nil {
+			return fmt.Errorf("cannot unmarshal entry %q in archive %q: %v", hdr.Name, s.fn, err)
+		}
+		metas = append(metas, meta)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]SnapshotMeta, 0, len(metas))
+	for _, meta := range metas {
+		if _, ok := blobs[tarEntryName(meta.Source, meta.BlobName())]; ok {
+			ret = append(ret, meta)
+		}
+	}
+	sortSnapshotMetas(ret)
+	return ret, nil
+}
+
+func (s *TarStore) Latest(ctx context.Context, source string) (SnapshotMeta, error) {
+	return latestSnapshotMeta(ctx, s, source)
+}
+
+func (s *TarStore) Delete(ctx context.Context, source string, checksum string) error {
+	blobName := tarEntryName(source, checksum+BlobExt)
+	metaName := tarEntryName(source, checksum+SnapshotMetaExt)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exists, err := s.has(blobName)
+	if err != nil || !exists {
+		return err
+	}
+	skip := func(name string) bool {
+		return name == blobName || name == metaName
+	}
+	return s.rewrite(ctx, skip, nil)
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// vim: cc=120:
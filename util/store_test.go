@@ -0,0 +1,175 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	tests := []struct {
+		name     string
+		newStore func(t *testing.T) Store
+	}{
+		{"fs", func(t *testing.T) Store { return NewFSStore(t.TempDir(), true) }},
+		{"mem", func(t *testing.T) Store { return NewMemStore() }},
+		{"tar", func(t *testing.T) Store { return NewTarStore(filepath.Join(t.TempDir(), "snapshots.tar"), true) }},
+	}
+	for _, test := range tests {
+		checkStore(t, test.name, test.newStore(t))
+	}
+}
+
+func TestFSStoreDeleteSharedBlob(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := NewFSStore(dir, true)
+	for _, source := range []string{"a", "b"} {
+		if _, err := s.Put(ctx, SnapshotMeta{Source: source}, strings.NewReader("one"), 0); err != nil {
+			t.Fatalf("Put(%s) failed: %v", source, err)
+		}
+	}
+	blobs := func() []string {
+		t.Helper()
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+BlobExt))
+		if err != nil {
+			t.Fatalf("listing blobs failed: %v", err)
+		}
+		return matches
+	}
+	if got := blobs(); len(got) != 1 {
+		t.Fatalf("sources store blobs %v, want a single shared one", got)
+	}
+	checksum := strings.TrimSuffix(filepath.Base(blobs()[0]), BlobExt)
+	if err := s.Delete(ctx, "a", checksum); err != nil || len(blobs()) != 1 {
+		t.Errorf("Delete of one source returned %v and left blobs %v, want the shared one kept", err, blobs())
+	}
+	if err := s.Delete(ctx, "b", checksum); err != nil || len(blobs()) != 0 {
+		t.Errorf("Delete of both sources returned %v and left blobs %v, want none", err, blobs())
+	}
+}
+
+// checkStore runs through the life of a few snapshots in s, which must be empty.
+func checkStore(t *testing.T, name string, s Store) {
+	t.Helper()
+	ctx := context.Background()
+	at := time.Date(2025, 7, 12, 10, 0, 0, 0, time.UTC)
+	put := func(source, contents string, fetchEnd time.Time) SnapshotMeta {
+		t.Helper()
+		meta, err := s.Put(ctx, SnapshotMeta{Source: source, FetchEnd: fetchEnd}, strings.NewReader(contents), 0)
+		if err != nil {
+			t.Fatalf("%s: Put(%s, %q) failed: %v", name, source, contents, err)
+		}
+		return meta
+	}
+	// get returns the contents of a snapshot, or the error of Get
+	get := func(source, checksum string) (string, error) {
+		t.Helper()
+		r, meta, err := s.Get(ctx, source, checksum)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		contents, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: reading snapshot failed: %v", name, err)
+		}
+		if meta.Source != source || meta.Checksum != checksum || meta.Size != int64(len(contents)) {
+			t.Errorf("%s: Get(%s, %s) returned metadata %+v", name, source, checksum, meta)
+		}
+		return string(contents), nil
+	}
+	// checksums lists the checksums of the snapshots of source, oldest first
+	checksums := func(source string) []string {
+		t.Helper()
+		metas, err := s.List(ctx, source)
+		if err != nil {
+			t.Fatalf("%s: List(%s) failed: %v", name, source, err)
+		}
+		ret := make([]string, 0, len(metas))
+		for _, meta := range metas {
+			ret = append(ret, meta.Checksum)
+		}
+		return ret
+	}
+
+	if _, err := s.Latest(ctx, "a"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("%s: Latest of an empty store returned %v, want ErrSnapshotNotFound", name, err)
+	}
+	one := put("a", "one", at)
+	two := put("a", "two", at.Add(time.Minute))
+	if one.Checksum != "7692c3ad3540bb803c020b3aee66cd8887123234ea0c6e7143c0add73ff431ed" || one.Size != 3 {
+		t.Errorf("%s: Put returned checksum %s and size %d", name, one.Checksum, one.Size)
+	}
+	if meta, err := s.Put(ctx, SnapshotMeta{Source: "a"}, strings.NewReader("one"), 0); !errors.Is(err, ErrDestinationExists) || meta.Checksum != one.Checksum {
+		t.Errorf("%s: Put of existing contents returned %s, %v, want ErrDestinationExists", name, meta.Checksum, err)
+	}
+	if _, err := s.Put(ctx, SnapshotMeta{Source: "a"}, strings.NewReader("three"), 4); !errors.Is(err, ErrMaxSizeExceeded) {
+		t.Errorf("%s: Put of too large contents returned %v, want ErrMaxSizeExceeded", name, err)
+	}
+	if contents, err := get("a", one.Checksum); err != nil || contents != "one" {
+		t.Errorf("%s: Get returned %q, %v, want %q", name, contents, err, "one")
+	}
+	if _, err := get("b", one.Checksum); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("%s: Get of another source returned %v, want ErrSnapshotNotFound", name, err)
+	}
+	if got := checksums("a"); len(got) != 2 || got[0] != one.Checksum || got[1] != two.Checksum {
+		t.Errorf("%s: List returned %v, want %s, %s", name, got, one.Checksum, two.Checksum)
+	}
+	if latest, err := s.Latest(ctx, "a"); err != nil || latest.Checksum != two.Checksum {
+		t.Errorf("%s: Latest returned %s, %v, want %s", name, latest.Checksum, err, two.Checksum)
+	}
+
+	// PutMeta makes an earlier snapshot the latest one again
+	one.FetchEnd = at.Add(2 * time.Minute)
+	if err := s.PutMeta(ctx, one); err != nil {
+		t.Errorf("%s: PutMeta failed: %v", name, err)
+	}
+	if latest, err := s.Latest(ctx, "a"); err != nil || latest.Checksum != one.Checksum {
+		t.Errorf("%s: Latest after PutMeta returned %s, %v, want %s", name, latest.Checksum, err, one.Checksum)
+	}
+	if err := s.PutMeta(ctx, SnapshotMeta{Source: "a", Checksum: "0123"}); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("%s: PutMeta of a missing snapshot returned %v, want ErrSnapshotNotFound", name, err)
+	}
+
+	// Another source with the same contents
+	shared := put("b", "one", at.Add(3*time.Minute))
+	if shared.Checksum != one.Checksum {
+		t.Errorf("%s: Put of the same contents returned checksum %s, want %s", name, shared.Checksum, one.Checksum)
+	}
+	if got := checksums(""); len(got) != 3 {
+		t.Errorf("%s: List of all sources returned %v, want 3 snapshots", name, got)
+	}
+	if latest, err := s.Latest(ctx, ""); err != nil || latest.Source != "b" {
+		t.Errorf("%s: Latest of all sources returned %+v, %v, want the one of b", name, latest, err)
+	}
+
+	// Deleting the snapshot of one source leaves the other one alone
+	if err := s.Delete(ctx, "a", one.Checksum); err != nil {
+		t.Errorf("%s: Delete failed: %v", name, err)
+	}
+	if _, err := get("a", one.Checksum); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("%s: Get of a deleted snapshot returned %v, want ErrSnapshotNotFound", name, err)
+	}
+	if contents, err := get("b", one.Checksum); err != nil || contents != "one" {
+		t.Errorf("%s: Get of the shared snapshot returned %q, %v, want %q", name, contents, err, "one")
+	}
+	if got := checksums("a"); len(got) != 1 || got[0] != two.Checksum {
+		t.Errorf("%s: List after Delete returned %v, want %s", name, got, two.Checksum)
+	}
+	if err := s.Delete(ctx, "a", one.Checksum); err != nil {
+		t.Errorf("%s: Delete of a deleted snapshot failed: %v", name, err)
+	}
+	if err := s.Delete(ctx, "b", one.Checksum); err != nil {
+		t.Errorf("%s: Delete of the shared snapshot failed: %v", name, err)
+	}
+	if got := checksums(""); len(got) != 1 || got[0] != two.Checksum {
+		t.Errorf("%s: List of all sources after Delete returned %v, want %s", name, got, two.Checksum)
+	}
+}
+
+// vim: cc=120: